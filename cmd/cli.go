@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/wlynxg/NetHive/core/config"
+	"github.com/wlynxg/NetHive/core/control"
+	"github.com/wlynxg/NetHive/core/engine"
+)
+
+// clientFlags are the flags shared by the commands talking to the daemon
+type clientFlags struct {
+	fs     *flag.FlagSet
+	socket string
+	json   bool
+}
+
+func newClientFlags(name string) *clientFlags {
+	f := &clientFlags{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.fs.StringVar(&f.socket, "socket", config.DefaultControlSocket, "control socket of the daemon")
+	f.fs.BoolVar(&f.json, "json", false, "print JSON output")
+	return f
+}
+
+func (f *clientFlags) client() *control.Client {
+	return control.NewClient(f.socket)
+}
+
+func status(args []string) error {
+	f := newClientFlags("status")
+	f.fs.Parse(args)
+
+	s, err := f.client().Status()
+	if err != nil {
+		return err
+	}
+	if f.json {
+		return printJSON(s)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintf(w, "Peer ID:\t%s\n", s.PeerID)
+	fmt.Fprintf(w, "Address:\t%s\n", s.LocalAddr)
+	if s.PrivateNetwork {
+		fmt.Fprintf(w, "PSK:\tprivate network\n")
+	}
+	if s.LocalAddr6.IsValid() {
+		fmt.Fprintf(w, "Address6:\t%s\n", s.LocalAddr6)
+	}
+	if s.DNSDomain != "" {
+		fmt.Fprintf(w, "MagicDNS:\t%s\n", s.DNSDomain)
+	}
+	fmt.Fprintf(w, "DHT:\t%s\n", dhtStatus(s.DHT))
+	if s.Network.Name != "" {
+		fmt.Fprintf(w, "Network:\t%s, admin %s, member list version %d\n", s.Network.Name, s.Network.Admin, s.Network.MemberListVersion)
+	}
+	fmt.Fprintf(w, "Traffic:\ttx %d packets %s, rx %d packets %s, dropped %d, spoofed %d\n",
+		s.Counters.TxPackets, formatBytes(s.Counters.TxBytes),
+		s.Counters.RxPackets, formatBytes(s.Counters.RxBytes), s.Counters.Dropped, s.Counters.Spoofed)
+	fmt.Fprintf(w, "Listen:\t%s\n", strings.Join(s.ListenAddrs, "\n\t"))
+	return w.Flush()
+}
+
+func peers(args []string) error {
+	f := newClientFlags("peers")
+	f.fs.Parse(args)
+
+	list, err := f.client().Peers()
+	if err != nil {
+		return err
+	}
+	if f.json {
+		return printJSON(list)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "PEER\tNAME\tADDRESS\tONLINE\tSTATE\tPATH\tRTT\tTX\tRX\tDROPPED\tSPOOFED\tVIA")
+	for _, p := range list {
+		addr := "-"
+		if p.Prefix.IsValid() {
+			addr = p.Prefix.String()
+		}
+		via := "-"
+		if len(p.Addrs) > 0 {
+			via = p.Addrs[0]
+		}
+		name := p.Name
+		if name == "" {
+			name = "-"
+		}
+		path := p.Path
+		if r := p.Relay; r != nil {
+			path = fmt.Sprintf("%s (%s/%s, %s/%s)", path, r.Elapsed.Round(time.Second), r.LimitDuration,
+				formatBytes(max(r.Sent, r.Received)), formatBytes(r.LimitData))
+		}
+		rtt := "-"
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(10 * time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", p.ID, name, addr, p.Online, p.State, path, rtt,
+			formatBytes(p.Counters.TxBytes), formatBytes(p.Counters.RxBytes), p.Counters.Dropped, p.Counters.Spoofed, via)
+	}
+	return w.Flush()
+}
+
+func routes(args []string) error {
+	f := newClientFlags("routes")
+	f.fs.Parse(args)
+
+	list, err := f.client().Routes()
+	if err != nil {
+		return err
+	}
+	if f.json {
+		return printJSON(list)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "PREFIX\tPEER")
+	for _, r := range list {
+		fmt.Fprintf(w, "%s\t%s\n", r.Prefix, r.PeerID)
+	}
+	return w.Flush()
+}
+
+func flows(args []string) error {
+	f := newClientFlags("flows")
+	f.fs.Parse(args)
+
+	list, err := f.client().Flows()
+	if err != nil {
+		return err
+	}
+	if f.json {
+		return printJSON(list)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "PROTO\tSRC\tDST\tDIR\tSTATE\tPEER\tORIG\tREPLY\tEXPIRES")
+	for _, fl := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", fl.Protocol, fl.Src, fl.Dst, fl.Direction, fl.State,
+			fl.PeerID, formatBytes(fl.OrigBytes), formatBytes(fl.ReplyBytes), time.Until(fl.Expires).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func pingPeer(args []string) error {
+	f := newClientFlags("ping")
+	count := f.fs.Int("c", 4, "number of pings")
+	f.fs.Parse(args)
+	if f.fs.NArg() != 1 {
+		return errors.New("usage: ping [flags] <peer|ip>")
+	}
+
+	results, err := f.client().Ping(f.fs.Arg(0), *count)
+	if err != nil {
+		return err
+	}
+	if f.json {
+		return printJSON(results)
+	}
+
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Printf("ping %s: %s\n", r.PeerID, r.Error)
+			continue
+		}
+		fmt.Printf("pong from %s via %s in %s\n", r.PeerID, r.Addr, r.RTT)
+	}
+	return nil
+}
+
+func keygen(args []string) error {
+	var asJSON, psk bool
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.BoolVar(&asJSON, "json", false, "print JSON output")
+	fs.BoolVar(&psk, "psk", false, "generate a PrivateNetworkKey instead")
+	fs.Parse(args)
+
+	if psk {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(struct{ PrivateNetworkKey string }{hex.EncodeToString(key)})
+		}
+		fmt.Printf("PrivateNetworkKey: %s\n", hex.EncodeToString(key))
+		return nil
+	}
+
+	pk, err := config.NewPrivateKey()
+	if err != nil {
+		return err
+	}
+	key, err := pk.PrivKey()
+	if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(struct {
+			PrivateKey *config.PrivateKey
+			PeerID     string
+		}{pk, id.String()})
+	}
+	text, _ := pk.MarshalText()
+	fmt.Printf("PrivateKey: %s\nPeerID: %s\n", text, id)
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func newTabWriter() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+func dhtStatus(dht engine.DHTStatus) string {
+	if !dht.Enabled {
+		return "disabled"
+	}
+	mode := dht.Mode
+	if dht.Server {
+		mode += " server"
+	}
+	return fmt.Sprintf("%s, %d peers in routing table", mode, dht.RoutingTableSize)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
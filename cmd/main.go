@@ -1,46 +1,58 @@
 package main
 
 import (
-	"context"
-	"flag"
-	"log"
-	"net/http"
-	_ "net/http/pprof"
-
-	"github.com/wlynxg/NetHive/core/config"
-	"github.com/wlynxg/NetHive/core/engine"
+	"fmt"
+	"os"
+	"strings"
 )
 
-type args struct {
-	config string
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
 }
 
-func parse() *args {
-	param := &args{}
-	flag.StringVar(&param.config, "config", "/var/lib/NetHive/config.json", `configuration file path`)
-	flag.Parse()
-	return param
+var commands = []command{
+	{"up", "run the daemon", up},
+	{"status", "show the status of the daemon", status},
+	{"peers", "list peers and their sessions", peers},
+	{"routes", "list the route table", routes},
+	{"flows", "list the flows tracked by the stateful firewall", flows},
+	{"ping", "ping a peer by peer ID or overlay IP", pingPeer},
+	{"keygen", "generate a private key and its peer ID", keygen},
 }
 
-func main() {
-	params := parse()
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
 
-	go func() {
-		http.ListenAndServe(":6060", nil)
-	}()
+func main() {
+	// running without command or with flags only starts the daemon as before
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") && os.Args[1] != "-h" && os.Args[1] != "--help" {
+		exit(up(os.Args[1:]))
+	}
 
-	cfg, err := config.Load(params.config)
-	if err != nil {
-		log.Fatal(err)
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			exit(c.run(os.Args[2:]))
+		}
 	}
 
-	e, err := engine.Run(context.Background(), cfg)
-	if err != nil {
-		log.Fatal(err)
+	usage()
+	if name != "-h" && name != "--help" && name != "help" {
+		os.Exit(2)
 	}
+}
 
-	err = e.Run()
+func exit(err error) {
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	os.Exit(0)
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/wlynxg/NetHive/core/config"
+	"github.com/wlynxg/NetHive/core/control"
+	"github.com/wlynxg/NetHive/core/engine"
+)
+
+func up(args []string) error {
+	var configPath string
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "/var/lib/NetHive/config.json", `configuration file path`)
+	fs.Parse(args)
+
+	go func() {
+		http.ListenAndServe(":6060", nil)
+	}()
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	// cancel the engine on exit signals, so that it can restore the system
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	e, err := engine.Run(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ControlSocket != "" {
+		go func() {
+			if err := control.New(cfg.ControlSocket, e).Serve(ctx); err != nil {
+				log.Printf("control api stopped: %v", err)
+			}
+		}()
+	}
+
+	go watchConfig(ctx, configPath, e)
+
+	return e.Run()
+}
+
+// watchConfig reload the config when its file changes or SIGHUP is received
+func watchConfig(ctx context.Context, path string, e *engine.Engine) {
+	// loading rewrites the file with defaults, the rewritten content must not reload again
+	var mu sync.Mutex
+	last, _ := os.ReadFile(path)
+	reload := func(force bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// a missing file would be regenerated with a new identity by config.Load
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("fail to reload config: %v", err)
+			return
+		}
+		if !force && bytes.Equal(data, last) {
+			return
+		}
+		cfg, err := config.Load(path)
+		if err != nil {
+			log.Printf("fail to reload config: %v", err)
+			return
+		}
+		last, _ = os.ReadFile(path)
+		if _, err := e.Reload(cfg); err != nil {
+			log.Printf("fail to reload config: %v", err)
+		}
+	}
+
+	go func() {
+		if err := config.Watch(ctx, path, func() { reload(false) }); err != nil {
+			log.Printf("stop watching config: %v", err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload(true)
+		}
+	}
+}
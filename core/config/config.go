@@ -1,15 +1,73 @@
 package config
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/netip"
+	"os"
+	"runtime"
+	"slices"
 
 	"github.com/gogf/gf/v2/encoding/gjson"
 	"github.com/gogf/gf/v2/os/gfile"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	mlog "github.com/wlynxg/NetHive/pkgs/log"
 )
 
+const (
+	// AddressModeStatic use the LocalAddr set by user
+	AddressModeStatic = "static"
+	// AddressModeAuto allocate LocalAddr from AddressPool automatically
+	AddressModeAuto = "auto"
+
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+
+	// DHTModePublic join the public IPFS DHT
+	DHTModePublic = "public"
+	// DHTModePrivate run an isolated DHT of NetHive nodes, bootstrapped only from Bootstraps
+	DHTModePrivate = "private"
+	// DHTProtocolPrefix makes the protocol of private DHT /nethive/kad/1.0.0
+	DHTProtocolPrefix = "/nethive"
+)
+
+var (
+	DefaultAddressPool   = netip.MustParsePrefix("192.168.168.0/24")
+	DefaultControlSocket = "/var/run/NetHive.sock"
+)
+
+// ACL is the firewall of the overlay, the first rule matching a packet decides
+// its fate, packets matching no rule follow DefaultPolicy
+type ACL struct {
+	// DefaultPolicy is ACLAllow or ACLDeny
+	DefaultPolicy string
+	// Stateful tracks connections, replies of allowed flows always pass, while
+	// inbound packets of new flows are denied unless a rule allows them
+	Stateful bool
+	// Groups name sets of peer IDs, rules refer to a group as "group:<name>"
+	Groups map[string][]string
+	Rules  []ACLRule
+}
+
+type ACLRule struct {
+	// Action is ACLAllow or ACLDeny
+	Action string
+	// Direction is "in" for packets from peers, "out" for packets to peers, empty for both
+	Direction string
+	// Peers are peer IDs or groups, empty matches all peers
+	Peers []string
+	// Protocol is "tcp", "udp", "icmp" or empty for any protocol
+	Protocol string
+	// Dst matches the destination address, empty matches any address
+	Dst []netip.Prefix
+	// Ports are destination ports or ranges like "8000-8100" of tcp and udp, empty matches any port
+	Ports []string
+}
+
 type Config struct {
 	path string
 
@@ -18,27 +76,91 @@ type Config struct {
 	MTU             int
 	LocalAddr       netip.Prefix
 	EnableBroadcast bool
+	TUNQueues       int
+	// assign an IPv6 address derived from PeerID, peers are reachable by their
+	// derived addresses without being listed in PeersRouteTable
+	EnableOverlayIPv6 bool
+
+	// ipam
+	AddressMode      string
+	AddressPool      netip.Prefix
+	AddressClaimedAt int64
 
 	// libp2p
 	PrivateKey      *PrivateKey
 	PeerID          string
 	Bootstraps      []string
 	PeersRouteTable map[string]netip.Prefix
+	// DHTMode is DHTModePublic or DHTModePrivate
+	DHTMode string
+	// DHTServer answers DHT queries of other nodes, in private mode the other nodes are clients
+	DHTServer bool
+	// peers whose route announcements are accepted, other members may only announce their overlay address
+	TrustedPeers []string
+	// announced IPv4 and IPv6 prefixes shorter than these are ignored, 8 and 32 by default
+	AnnounceMinBits4 int
+	AnnounceMinBits6 int
+	// name announced to peers, the hostname by default
+	NodeName        string
 	Relays          []string
 	EnableAutoRelay bool
 	EnableMDNS      bool
+	// hex encoded 32 bytes pre-shared key, only nodes with the same key can connect to each other
+	PrivateNetworkKey string
+	// nodes of a network find each other in a DHT namespace derived from the secret,
+	// PrivateNetworkKey is used if it's empty
+	DiscoverySecret string
+
+	// network membership, members are signed by the admin peer and spread by gossip
+	NetworkName  string
+	NetworkAdmin string
+	// members signed by the admin node, other nodes ignore it
+	NetworkMembers []string
+
+	// subnet router
+	AdvertiseRoutes  []netip.Prefix
+	PeersSubnets     map[string][]netip.Prefix
+	EnableIPForward  bool
+	EnableMasquerade bool
+
+	// firewall of the overlay
+	ACL ACL
+
+	// MagicDNS answers <NodeName>.<NetworkName>.hive on the overlay address
+	EnableMagicDNS bool
+	// resolvers of other domains, the nameservers of /etc/resolv.conf by default
+	DNSUpstreams []string
+	// point the system resolver to MagicDNS for the overlay domain
+	DNSConfigureSystem bool
+
+	// exit node
+	ExitNode          string
+	AdvertiseExitNode bool
+
+	// unix socket of the control api
+	ControlSocket string
 
 	// log
 	LogConfigs []mlog.CoreConfig
 }
 
+// Save write the config to its file, the file is left untouched if nothing changes,
+// so that saving doesn't trigger the watcher needlessly
 func (c *Config) Save() error {
-	if err := gfile.PutBytes(c.path, gjson.New(c).MustToJsonIndent()); err != nil {
+	data := gjson.New(c).MustToJsonIndent()
+	if gfile.Exists(c.path) && bytes.Equal(gfile.GetBytes(c.path), data) {
+		return nil
+	}
+	if err := gfile.PutBytes(c.path, data); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (c *Config) Path() string {
+	return c.path
+}
+
 func Load(path string) (*Config, error) {
 	cfg := &Config{path: path}
 	if gfile.Exists(path) {
@@ -73,8 +195,61 @@ func defaultConfig(cfg *Config) error {
 		cfg.MTU = 1500
 	}
 
-	if !cfg.LocalAddr.IsValid() {
-		cfg.LocalAddr = netip.MustParsePrefix("192.168.168.1/24")
+	if cfg.TUNQueues <= 0 {
+		cfg.TUNQueues = runtime.NumCPU()
+	}
+
+	// a node without address uses auto address mode, so that nodes with default config never collide
+	if cfg.AddressMode == "" {
+		if cfg.LocalAddr.IsValid() {
+			cfg.AddressMode = AddressModeStatic
+		} else {
+			cfg.AddressMode = AddressModeAuto
+		}
+	}
+
+	switch cfg.AddressMode {
+	case AddressModeStatic:
+		if !cfg.LocalAddr.IsValid() {
+			cfg.LocalAddr = netip.MustParsePrefix("192.168.168.1/24")
+		}
+	case AddressModeAuto:
+		if !cfg.AddressPool.IsValid() {
+			cfg.AddressPool = DefaultAddressPool
+		}
+	default:
+		return fmt.Errorf("unknown address mode: %s", cfg.AddressMode)
+	}
+
+	switch cfg.DHTMode {
+	case "":
+		cfg.DHTMode = DHTModePublic
+	case DHTModePublic:
+	case DHTModePrivate:
+		if err := checkPrivateDHT(cfg); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown DHT mode: %s", cfg.DHTMode)
+	}
+
+	if cfg.AnnounceMinBits4 <= 0 {
+		cfg.AnnounceMinBits4 = 8
+	}
+	if cfg.AnnounceMinBits6 <= 0 {
+		cfg.AnnounceMinBits6 = 32
+	}
+
+	if cfg.ACL.DefaultPolicy == "" {
+		cfg.ACL.DefaultPolicy = ACLAllow
+	}
+
+	if cfg.NodeName == "" {
+		cfg.NodeName, _ = os.Hostname()
+	}
+
+	if cfg.ControlSocket == "" {
+		cfg.ControlSocket = DefaultControlSocket
 	}
 
 	if cfg.PrivateKey == nil {
@@ -90,10 +265,68 @@ func defaultConfig(cfg *Config) error {
 		cfg.PeerID = id.String()
 	}
 
-	if len(cfg.Bootstraps) == 0 {
+	if cfg.PrivateNetworkKey != "" {
+		return checkPrivateNetwork(cfg)
+	}
+
+	if len(cfg.Bootstraps) == 0 && cfg.DHTMode == DHTModePublic {
 		for _, n := range dht.DefaultBootstrapPeers {
 			cfg.Bootstraps = append(cfg.Bootstraps, n.String())
 		}
 	}
 	return nil
 }
+
+// PSK decode PrivateNetworkKey, it's nil for public network
+func (c *Config) PSK() (pnet.PSK, error) {
+	if c.PrivateNetworkKey == "" {
+		return nil, nil
+	}
+	psk, err := hex.DecodeString(c.PrivateNetworkKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PrivateNetworkKey: %w", err)
+	}
+	if len(psk) != 32 {
+		return nil, fmt.Errorf("invalid PrivateNetworkKey: need 32 bytes, got %d", len(psk))
+	}
+	return psk, nil
+}
+
+// checkPrivateDHT make sure a node of private DHT is bootstrapped from NetHive nodes,
+// public bootstraps don't speak its protocol. Only a DHT server may start alone.
+func checkPrivateDHT(cfg *Config) error {
+	for _, s := range cfg.Bootstraps {
+		if _, err := peer.AddrInfoFromString(s); err != nil {
+			return fmt.Errorf("invalid bootstrap %s: %w", s, err)
+		}
+	}
+	for _, n := range dht.DefaultBootstrapPeers {
+		if slices.Contains(cfg.Bootstraps, n.String()) {
+			return fmt.Errorf("public bootstrap %s doesn't serve private DHT, remove it from Bootstraps", n)
+		}
+	}
+	if len(cfg.Bootstraps) == 0 && !cfg.DHTServer {
+		return errors.New("private DHT requires Bootstraps of NetHive DHT servers")
+	}
+	return nil
+}
+
+// checkPrivateNetwork make sure a node of private network has bootstraps it can reach,
+// public bootstraps never complete the handshake without the key
+func checkPrivateNetwork(cfg *Config) error {
+	if _, err := cfg.PSK(); err != nil {
+		return err
+	}
+
+	for _, n := range dht.DefaultBootstrapPeers {
+		if slices.Contains(cfg.Bootstraps, n.String()) {
+			return fmt.Errorf("public bootstrap %s is unreachable in private network, "+
+				"remove it from Bootstraps", n)
+		}
+	}
+	if len(cfg.Bootstraps) == 0 && !cfg.EnableMDNS {
+		return errors.New("private network requires Bootstraps of nodes with the same PrivateNetworkKey, " +
+			"or EnableMDNS to find them in local network")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// WatchDebounce merges the events of one write, editors often write a file in several steps
+	WatchDebounce = 500 * time.Millisecond
+)
+
+// Watch call fn after the file at path is changed until ctx is done. The directory
+// is watched instead of the file, since editors usually replace the file by renaming.
+func Watch(ctx context.Context, path string, fn func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(WatchDebounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			return err
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+			timer.Reset(WatchDebounce)
+		case <-timer.C:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/wlynxg/NetHive/core/engine"
+)
+
+// Client talks to the control API of a running daemon
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{http: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+func (c *Client) Status() (engine.Status, error) {
+	var status engine.Status
+	err := c.get("/status", nil, &status)
+	return status, err
+}
+
+func (c *Client) Peers() ([]engine.PeerStatus, error) {
+	var peers []engine.PeerStatus
+	err := c.get("/peers", nil, &peers)
+	return peers, err
+}
+
+func (c *Client) Routes() ([]engine.RouteStatus, error) {
+	var routes []engine.RouteStatus
+	err := c.get("/routes", nil, &routes)
+	return routes, err
+}
+
+func (c *Client) Flows() ([]engine.FlowStatus, error) {
+	var flows []engine.FlowStatus
+	err := c.get("/flows", nil, &flows)
+	return flows, err
+}
+
+func (c *Client) Ping(target string, count int) ([]engine.PingResult, error) {
+	var results []engine.PingResult
+	query := url.Values{"target": {target}, "count": {strconv.Itoa(count)}}
+	err := c.get("/ping", query, &results)
+	return results, err
+}
+
+func (c *Client) get(path string, query url.Values, v any) error {
+	u := url.URL{Scheme: "http", Host: "NetHive", Path: path, RawQuery: query.Encode()}
+	resp, err := c.http.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("fail to connect to daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
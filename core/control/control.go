@@ -0,0 +1,168 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/wlynxg/NetHive/core/engine"
+	mlog "github.com/wlynxg/NetHive/pkgs/log"
+)
+
+const (
+	// SocketMode only allows the owner and the group of the socket to connect
+	SocketMode = 0660
+	// ShutdownTimeout is the time waiting for running requests on exit
+	ShutdownTimeout = 3 * time.Second
+	PingTimeout     = time.Minute
+	MaxPingCount    = 30
+)
+
+// Server serves the control API over HTTP on a Unix domain socket, every request
+// and response body is JSON
+type Server struct {
+	log    *mlog.Logger
+	e      *engine.Engine
+	path   string
+	server *http.Server
+}
+
+// RouteRequest is the body of adding a peer route
+type RouteRequest struct {
+	PeerID string
+	Prefix netip.Prefix
+}
+
+type errorResponse struct {
+	Error string
+}
+
+func New(path string, e *engine.Engine) *Server {
+	s := &Server{
+		log:  mlog.New("control"),
+		e:    e,
+		path: path,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /peers", s.handlePeers)
+	mux.HandleFunc("GET /routes", s.handleRoutes)
+	mux.HandleFunc("POST /routes", s.handleAddRoute)
+	mux.HandleFunc("DELETE /routes", s.handleDelRoute)
+	mux.HandleFunc("GET /ping", s.handlePing)
+	mux.HandleFunc("GET /flows", s.handleFlows)
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// Serve listen on the socket and serve until ctx is done, the socket file is removed on exit
+func (s *Server) Serve(ctx context.Context) error {
+	// remove the socket left by a crashed process
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.path)
+
+	if err := os.Chmod(s.path, SocketMode); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		s.server.Shutdown(ctx)
+	}()
+
+	s.log.Infof("control api listen on %s", s.path)
+	err = s.server.Serve(&credListener{Listener: listener, log: s.log})
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.e.Status())
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.e.Peers())
+}
+
+func (s *Server) handleRoutes(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.e.Routes())
+}
+
+func (s *Server) handleFlows(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.e.Flows())
+}
+
+func (s *Server) handleAddRoute(w http.ResponseWriter, r *http.Request) {
+	var req RouteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.e.AddPeerRoute(req.PeerID, req.Prefix); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.log.Infof("add route %s to %s", req.Prefix, req.PeerID)
+	writeJSON(w, http.StatusOK, s.e.Routes())
+}
+
+func (s *Server) handleDelRoute(w http.ResponseWriter, r *http.Request) {
+	prefix, err := netip.ParsePrefix(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.e.DelPeerRoute(prefix); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	s.log.Infof("delete route %s", prefix)
+	writeJSON(w, http.StatusOK, s.e.Routes())
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 {
+		count = 1
+	}
+	if count > MaxPingCount {
+		count = MaxPingCount
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), PingTimeout)
+	defer cancel()
+	results, err := s.e.Ping(ctx, r.URL.Query().Get("target"), count)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
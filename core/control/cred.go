@@ -0,0 +1,28 @@
+package control
+
+import (
+	"net"
+
+	mlog "github.com/wlynxg/NetHive/pkgs/log"
+)
+
+// credListener drop connections of processes which are neither root nor the owner of the server
+type credListener struct {
+	net.Listener
+	log *mlog.Logger
+}
+
+func (l *credListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPeerCred(conn); err != nil {
+			l.log.Warnf("reject control connection: %v", err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
@@ -4,6 +4,13 @@ import (
 	"net/netip"
 )
 
+type Queue interface {
+	// Read data packets from device queue
+	Read([]byte) (int, error)
+	// Write data packets to device queue
+	Write([]byte) (int, error)
+}
+
 type Device interface {
 	// Read data packets from network device
 	Read([]byte) (int, error)
@@ -25,4 +32,6 @@ type Device interface {
 	Down() error
 	// State return the status of the network card, true means up, false means down
 	State() bool
+	// Queues return all queues of the network device, Read and Write of the device use the first one
+	Queues() []Queue
 }
@@ -32,6 +32,7 @@ type tun struct {
 	cacheTime time.Time
 	index     int32
 	tunFile   *os.File
+	queues    []*os.File
 	state     atomic.Bool
 }
 
@@ -44,7 +45,13 @@ func (t *tun) Write(buff []byte) (int, error) {
 }
 
 func (t *tun) Close() error {
-	return t.tunFile.Close()
+	var err error
+	for _, q := range t.queues {
+		if e := q.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (t *tun) MTU() (int, error) {
@@ -62,11 +69,17 @@ func (t *tun) Name() (string, error) {
 }
 
 func (t *tun) AddAddress(addr netip.Prefix) error {
+	if addr.Addr().Is6() {
+		return command.IP6AddAddr(addr, t.name)
+	}
 	return command.IP4AddAddr(addr, t.name)
 }
 
 func (t *tun) FlushAddress() error {
-	return command.IP4FlushAddr(t.name)
+	if err := command.IP4FlushAddr(t.name); err != nil {
+		return err
+	}
+	return command.IP6FlushAddr(t.name)
 }
 
 func (t *tun) Up() error {
@@ -81,6 +94,14 @@ func (t *tun) State() bool {
 	return t.state.Load()
 }
 
+func (t *tun) Queues() []Queue {
+	queues := make([]Queue, len(t.queues))
+	for i, q := range t.queues {
+		queues[i] = q
+	}
+	return queues
+}
+
 func (t *tun) changeState(state bool) error {
 	if t.state.Load() == state {
 		return nil
@@ -179,7 +200,7 @@ func (t *tun) getIFIndex() (int32, error) {
 	return *(*int32)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])), nil
 }
 
-func CreateTUN(name string, mtu int) (Device, error) {
+func openQueue(name string) (*os.File, error) {
 	tfd, err := unix.Open(cloneDevicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -190,6 +211,7 @@ func CreateTUN(name string, mtu int) (Device, error) {
 
 	ifreq, err := unix.NewIfreq(name)
 	if err != nil {
+		syscall.Close(tfd)
 		return nil, err
 	}
 
@@ -200,6 +222,7 @@ func CreateTUN(name string, mtu int) (Device, error) {
 	//ifreq.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
 	err = unix.IoctlIfreq(tfd, unix.TUNSETIFF, ifreq)
 	if err != nil {
+		syscall.Close(tfd)
 		return nil, err
 	}
 
@@ -210,30 +233,54 @@ func CreateTUN(name string, mtu int) (Device, error) {
 		return nil, err
 	}
 
-	file := os.NewFile(uintptr(tfd), cloneDevicePath)
+	return os.NewFile(uintptr(tfd), cloneDevicePath), nil
+}
+
+// CreateTUN create a TUN device with the given number of queues,
+// every queue is an independent file descriptor attached to the same device.
+func CreateTUN(name string, mtu int, queues int) (Device, error) {
+	file, err := openQueue(name)
+	if err != nil {
+		return nil, err
+	}
 
 	d := &tun{
 		tunFile:   file,
+		queues:    []*os.File{file},
 		cacheTime: time.Now(),
 	}
 
 	_, err = d.getNameFromSys()
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
+	// the kernel may assign a name to the device, so the other queues must use the real name
+	for i := 1; i < queues; i++ {
+		q, err := openQueue(d.name)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("failed to open queue %d of TUN device %s: %w", i, d.name, err)
+		}
+		d.queues = append(d.queues, q)
+	}
+
 	d.index, err = d.getIFIndex()
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
 	err = d.setMTU(mtu)
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
 	d.mtu, err = d.getMTUFromSys()
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 	return d, nil
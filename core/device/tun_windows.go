@@ -102,7 +102,12 @@ func (t *tun) State() bool {
 	return t.state.Load()
 }
 
-func CreateTUN(name string, mtu int) (Device, error) {
+func (t *tun) Queues() []Queue {
+	return []Queue{t}
+}
+
+// CreateTUN create a wintun device, wintun has only one session, so queues is ignored.
+func CreateTUN(name string, mtu int, queues int) (Device, error) {
 	adapter, err := wintun.CreateAdapter(name, WintunTunnelType, nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error creating interface: ")
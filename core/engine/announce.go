@@ -0,0 +1,413 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pkg/errors"
+)
+
+const (
+	RoutesProtocol        = "/NetHive/routes/1.0.0"
+	RoutesExchangeTimeout = 30 * time.Second
+	RoutesInterval        = time.Minute
+
+	routesSignDomain = "NetHive/routes:"
+	// maxAnnouncedPrefixes limits the prefixes accepted from one peer
+	maxAnnouncedPrefixes = 256
+)
+
+// RouteAnnouncement is a signed statement of a peer about the prefixes it owns,
+// a newer announcement of the same peer replaces the older one
+type RouteAnnouncement struct {
+	PeerID   string
+	Name     string
+	Prefixes []netip.Prefix
+	Seq      int64
+	// ExitNode report whether the peer advertises itself as an exit node
+	ExitNode  bool
+	Signature []byte
+}
+
+func (a *RouteAnnouncement) signedData() []byte {
+	prefixes := make([]string, len(a.Prefixes))
+	for i, prefix := range a.Prefixes {
+		prefixes[i] = prefix.String()
+	}
+	return []byte(fmt.Sprintf("%s|%s|%d|%t|%s", a.PeerID, a.Name, a.Seq, a.ExitNode, strings.Join(prefixes, ",")))
+}
+
+type announceState struct {
+	mu    sync.Mutex
+	local *RouteAnnouncement
+	// peers is the latest verified announcement of every peer
+	peers map[string]*RouteAnnouncement
+}
+
+// localAnnouncement return the announcement of this node, it's signed again when the owned prefixes change
+func (e *Engine) localAnnouncement() (*RouteAnnouncement, error) {
+	a := &RouteAnnouncement{
+		PeerID:   e.host.ID().String(),
+		Name:     e.cfg.NodeName,
+		ExitNode: e.cfg.AdvertiseExitNode,
+	}
+
+	e.ipam.mu.Lock()
+	if claim, ok := e.ipam.claims[a.PeerID]; ok {
+		a.Prefixes = append(a.Prefixes, netip.PrefixFrom(claim.Addr, claim.Addr.BitLen()))
+	}
+	e.ipam.mu.Unlock()
+	for _, prefix := range e.cfg.AdvertiseRoutes {
+		a.Prefixes = append(a.Prefixes, prefix.Masked())
+	}
+
+	e.announce.mu.Lock()
+	defer e.announce.mu.Unlock()
+
+	if local := e.announce.local; local != nil && local.Name == a.Name && local.ExitNode == a.ExitNode &&
+		slices.Equal(local.Prefixes, a.Prefixes) {
+		return local, nil
+	}
+
+	a.Seq = time.Now().UnixNano()
+	sig, err := e.signRecord(routesSignDomain, a.signedData())
+	if err != nil {
+		return nil, err
+	}
+	a.Signature = sig
+	e.announce.local = a
+	return a, nil
+}
+
+func (e *Engine) knownAnnouncements() ([]*RouteAnnouncement, error) {
+	local, err := e.localAnnouncement()
+	if err != nil {
+		return nil, err
+	}
+
+	e.announce.mu.Lock()
+	defer e.announce.mu.Unlock()
+
+	announcements := []*RouteAnnouncement{local}
+	for _, a := range e.announce.peers {
+		announcements = append(announcements, a)
+	}
+	return announcements, nil
+}
+
+// PeerName return the name announced by peer id
+func (e *Engine) PeerName(id string) string {
+	e.announce.mu.Lock()
+	defer e.announce.mu.Unlock()
+
+	if a, ok := e.announce.peers[id]; ok {
+		return a.Name
+	}
+	return ""
+}
+
+// mergeAnnouncements verify announcements received from peers and install the prefixes of member peers
+func (e *Engine) mergeAnnouncements(announcements []*RouteAnnouncement) {
+	self := e.host.ID().String()
+	for _, a := range announcements {
+		if a.PeerID == self || len(a.Prefixes) > maxAnnouncedPrefixes {
+			continue
+		}
+		if _, ok := e.routeTable.m.Load(a.PeerID); !ok {
+			continue
+		}
+
+		e.announce.mu.Lock()
+		old, ok := e.announce.peers[a.PeerID]
+		e.announce.mu.Unlock()
+		if ok && old.Seq >= a.Seq {
+			continue
+		}
+
+		id, err := peer.Decode(a.PeerID)
+		if err != nil {
+			continue
+		}
+		if err := e.verifyRecord(id, routesSignDomain, a.signedData(), a.Signature); err != nil {
+			e.log.Warnf("drop route announcement of %s: %v", a.PeerID, err)
+			continue
+		}
+
+		e.announce.mu.Lock()
+		// another exchange may have stored a newer one meanwhile
+		if cur, ok := e.announce.peers[a.PeerID]; ok && cur.Seq >= a.Seq {
+			e.announce.mu.Unlock()
+			continue
+		}
+		e.announce.peers[a.PeerID] = a
+		e.announce.mu.Unlock()
+
+		e.log.Debugf("peer %s(%s) announces %v", a.PeerID, a.Name, a.Prefixes)
+		e.routeAnnouncement(old, a)
+	}
+}
+
+// routeAnnouncement install the valid prefixes of a and remove the prefixes which are no longer announced or valid.
+// A prefix owned by another peer is never taken over, statically configured prefixes always win.
+func (e *Engine) routeAnnouncement(old, a *RouteAnnouncement) {
+	name, err := e.device.Name()
+	if err != nil {
+		return
+	}
+
+	e.ipam.mu.Lock()
+	configured := configuredPrefixes(e.cfg)[a.PeerID]
+	policy := e.announcePolicy(a.PeerID)
+	e.ipam.mu.Unlock()
+
+	valid := make(map[netip.Prefix]bool, len(a.Prefixes))
+	for _, prefix := range a.Prefixes {
+		if err := validAnnouncedPrefix(prefix, policy); err != nil {
+			e.log.Warnf("ignore %s's route %s: %v", a.PeerID, prefix, err)
+			continue
+		}
+		valid[prefix] = true
+	}
+
+	if old != nil {
+		for _, prefix := range old.Prefixes {
+			if valid[prefix] || configured[prefix] || e.routeTable.prefix.Owner(prefix) != a.PeerID {
+				continue
+			}
+			e.routeTable.prefix.Del(prefix)
+			e.delPeerRoute(prefix)
+			e.log.Infof("%s withdraws route %s", a.PeerID, prefix)
+		}
+	}
+
+	for _, prefix := range a.Prefixes {
+		if !valid[prefix] {
+			continue
+		}
+		if owner := e.routeTable.prefix.Owner(prefix); owner != "" && owner != a.PeerID {
+			e.log.Warnf("ignore %s's route %s: owned by %s", a.PeerID, prefix, owner)
+			continue
+		}
+		e.addPeerPrefix(name, a.PeerID, prefix)
+	}
+}
+
+// rerouteAnnouncements check the installed announcements again, e.g. after TrustedPeers is changed
+func (e *Engine) rerouteAnnouncements() {
+	e.announce.mu.Lock()
+	announcements := make([]*RouteAnnouncement, 0, len(e.announce.peers))
+	for _, a := range e.announce.peers {
+		announcements = append(announcements, a)
+	}
+	e.announce.mu.Unlock()
+
+	for _, a := range announcements {
+		if _, ok := e.routeTable.m.Load(a.PeerID); ok {
+			e.routeAnnouncement(a, a)
+		}
+	}
+}
+
+// announcePolicy limits what a peer may announce
+type announcePolicy struct {
+	// trusted peers may announce subnets, others only their overlay address
+	trusted  bool
+	local    netip.Prefix
+	overlay6 bool
+	minBits4 int
+	minBits6 int
+	// networks of local interfaces and underlay addresses of libp2p, they must stay out of the tunnel
+	underlay []netip.Prefix
+}
+
+// announcePolicy return the policy of peer id, the caller must hold e.ipam.mu
+func (e *Engine) announcePolicy(id string) announcePolicy {
+	policy := announcePolicy{
+		trusted:  slices.Contains(e.cfg.TrustedPeers, id),
+		local:    e.cfg.LocalAddr,
+		overlay6: e.addr6.IsValid(),
+		minBits4: e.cfg.AnnounceMinBits4,
+		minBits6: e.cfg.AnnounceMinBits6,
+	}
+	if !policy.trusted {
+		return policy
+	}
+
+	policy.underlay = e.localNetworks()
+	e.exit.bypass.Range(func(addr netip.Addr, _ struct{}) bool {
+		policy.underlay = append(policy.underlay, netip.PrefixFrom(addr, addr.BitLen()))
+		return true
+	})
+	for _, conn := range e.host.Network().Conns() {
+		if addr, err := addrFromMultiaddr(conn.RemoteMultiaddr()); err == nil && !policy.local.Contains(addr) {
+			policy.underlay = append(policy.underlay, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return policy
+}
+
+// localNetworks return the networks of the interfaces other than the TUN device
+func (e *Engine) localNetworks() []netip.Prefix {
+	dev, _ := e.device.Name()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		e.log.Warnf("fail to list interfaces: %v", err)
+		return nil
+	}
+
+	var networks []netip.Prefix
+	for _, iface := range ifaces {
+		if iface.Name == dev {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ip, _ := netip.AddrFromSlice(ipNet.IP)
+				bits, _ := ipNet.Mask.Size()
+				networks = append(networks, netip.PrefixFrom(ip.Unmap(), bits).Masked())
+			}
+		}
+	}
+	return networks
+}
+
+// validAnnouncedPrefix reject prefixes which would hijack the traffic of this node
+func validAnnouncedPrefix(prefix netip.Prefix, policy announcePolicy) error {
+	minBits := policy.minBits4
+	if prefix.Addr().Is6() {
+		minBits = policy.minBits6
+	}
+
+	switch {
+	case !prefix.IsValid() || prefix.Masked() != prefix:
+		return errors.New("invalid prefix")
+	case prefix.Bits() == 0:
+		return errors.New("default route must be selected by ExitNode")
+	case prefix.Contains(policy.local.Addr()):
+		return errors.New("contains the local address")
+	case policy.overlay6 && prefix.Overlaps(OverlayPrefix6):
+		return errors.New("overlaps the overlay IPv6 prefix")
+	case !policy.trusted:
+		// the address claim of a member
+		if prefix.IsSingleIP() && policy.local.Masked().Contains(prefix.Addr()) {
+			return nil
+		}
+		return errors.New("not a trusted peer")
+	case prefix.Bits() < minBits:
+		return errors.Errorf("shorter than /%d", minBits)
+	}
+	for _, underlay := range policy.underlay {
+		if prefix.Overlaps(underlay) {
+			return errors.Errorf("overlaps the local network or underlay address %s", underlay)
+		}
+	}
+	return nil
+}
+
+// forgetAnnouncement drop the announcement of a removed peer
+func (e *Engine) forgetAnnouncement(id string) {
+	e.announce.mu.Lock()
+	defer e.announce.mu.Unlock()
+	delete(e.announce.peers, id)
+}
+
+// RoutesHandler exchange route announcements with a member peer
+func (e *Engine) RoutesHandler(stream network.Stream) {
+	defer stream.Close()
+
+	id := stream.Conn().RemotePeer().String()
+	if _, ok := e.routeTable.m.Load(id); !ok {
+		stream.Reset()
+		return
+	}
+
+	stream.SetDeadline(time.Now().Add(RoutesExchangeTimeout))
+	var announcements []*RouteAnnouncement
+	if err := readRecords(stream, &announcements); err != nil {
+		e.log.Debugf("fail to read route announcements from %s: %v", id, err)
+		stream.Reset()
+		return
+	}
+	known, err := e.knownAnnouncements()
+	if err == nil {
+		err = writeRecords(stream, known)
+	}
+	if err != nil {
+		e.log.Debugf("fail to write route announcements to %s: %v", id, err)
+		stream.Reset()
+		return
+	}
+	e.mergeAnnouncements(announcements)
+}
+
+// announceLoop exchange route announcements with every member peer periodically
+func (e *Engine) announceLoop() {
+	ticker := time.NewTicker(RoutesInterval)
+	defer ticker.Stop()
+
+	for {
+		e.routeTable.m.Range(func(key string, _ netip.Prefix) bool {
+			go func(id string) {
+				if err := e.exchangeAnnouncements(id); err != nil {
+					e.log.Debugf("fail to exchange route announcements with %s: %v", id, err)
+				}
+			}(key)
+			return true
+		})
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Engine) exchangeAnnouncements(id string) error {
+	ctx, cancel := context.WithTimeout(e.ctx, RoutesExchangeTimeout)
+	defer cancel()
+
+	pid, err := peer.Decode(id)
+	if err != nil {
+		return err
+	}
+	if err := e.connect(ctx, pid); err != nil {
+		return err
+	}
+
+	stream, err := e.host.NewStream(ctx, pid, RoutesProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	known, err := e.knownAnnouncements()
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	stream.SetDeadline(time.Now().Add(RoutesExchangeTimeout))
+	if err := writeRecords(stream, known); err != nil {
+		stream.Reset()
+		return err
+	}
+	var announcements []*RouteAnnouncement
+	if err := readRecords(stream, &announcements); err != nil {
+		stream.Reset()
+		return err
+	}
+	e.mergeAnnouncements(announcements)
+	return nil
+}
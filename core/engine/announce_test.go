@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestValidAnnouncedPrefix(t *testing.T) {
+	trusted := announcePolicy{
+		trusted:  true,
+		local:    netip.MustParsePrefix("192.168.168.1/24"),
+		overlay6: true,
+		minBits4: 8,
+		minBits6: 32,
+		underlay: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("203.0.113.7/32"),
+		},
+	}
+	member := trusted
+	member.trusted = false
+
+	tests := []struct {
+		prefix string
+		policy announcePolicy
+		ok     bool
+	}{
+		{"172.16.0.0/16", trusted, true},
+		{"2001:db8::/48", trusted, true},
+		{"172.16.0.1/16", trusted, false},
+		{"0.0.0.0/0", trusted, false},
+		{"0.0.0.0/1", trusted, false},
+		{"2000::/3", trusted, false},
+		{"192.168.0.0/16", trusted, false},
+		{"192.168.168.1/32", trusted, false},
+		{"fd4e:6574::/32", trusted, false},
+		// local network and underlay addresses
+		{"10.1.0.0/16", trusted, false},
+		{"203.0.113.0/24", trusted, false},
+		{"203.0.112.0/24", trusted, true},
+		// members only announce their overlay address
+		{"192.168.168.2/32", member, true},
+		{"172.16.0.0/16", member, false},
+		{"192.168.168.1/32", member, false},
+	}
+	for _, tt := range tests {
+		err := validAnnouncedPrefix(netip.MustParsePrefix(tt.prefix), tt.policy)
+		if (err == nil) != tt.ok {
+			t.Errorf("validAnnouncedPrefix(%s, trusted %t) = %v, want ok %t", tt.prefix, tt.policy.trusted, err, tt.ok)
+		}
+	}
+}
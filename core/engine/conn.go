@@ -1,132 +1,91 @@
 package engine
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-msgio"
 	"github.com/mr-tron/base58/base58"
 )
 
 func (e *Engine) addConnByDst(dst netip.Addr) (PacketChan, error) {
-	e.log.Debugf("Try to connect to the corresponding node of %s", dst)
-
-	if c, ok := e.routeTable.addr.Load(dst); ok {
-		return c, nil
-	} else {
-		var conn PacketChan
-		e.routeTable.m.Range(func(key string, value netip.Prefix) bool {
-			if value.Addr().Compare(dst) != 0 {
-				return true
-			}
+	id, err := e.peerByDst(dst)
+	if err != nil {
+		return nil, err
+	}
+	return e.session(id, nil).queue, nil
+}
 
-			if c, ok := e.routeTable.id.Load(key); ok {
-				conn = c
-			} else {
-				conn = make(PacketChan, ChanSize)
-				e.routeTable.addr.Store(dst, conn)
-				e.routeTable.id.Store(key, conn)
-				go func() {
-					defer e.routeTable.id.Delete(key)
-					defer e.routeTable.addr.Delete(dst)
-					e.addConn(conn, key)
-				}()
-			}
-			return false
-		})
-		if conn != nil {
-			return conn, nil
-		}
+// peerByDst return the peer which the packets to dst are routed to
+func (e *Engine) peerByDst(dst netip.Addr) (string, error) {
+	_, id, ok := e.routeTable.prefix.Lookup(dst)
+	if !ok && e.isOverlay6(dst) {
+		id, ok = e.resolveAddr6(dst)
+	}
+	if !ok {
+		return "", errors.New(fmt.Sprintf("the routing rule corresponding to %s was not found", dst.String()))
 	}
+	return id, nil
+}
 
-	return nil, errors.New(fmt.Sprintf("the routing rule corresponding to %s was not found", dst.String()))
+// peerPrefix return the prefix owned by a peer in PeersRouteTable,
+// an address with host bits like 192.168.168.2/24 only owns the address itself
+func peerPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Masked() != prefix {
+		return netip.PrefixFrom(prefix.Addr(), prefix.Addr().BitLen())
+	}
+	return prefix
 }
 
 func (e *Engine) addConnByID(id string) (PacketChan, error) {
 	e.log.Debugf("Try to connect to the corresponding node of %s", id)
 
-	if conn, ok := e.routeTable.id.Load(id); ok {
-		return conn, nil
+	if _, ok := e.routeTable.m.Load(id); !ok {
+		return nil, errors.New(fmt.Sprintf("unknown peer: %s", id))
 	}
+	return e.session(id, nil).queue, nil
+}
 
-	peerChan := make(PacketChan, ChanSize)
-	e.routeTable.id.Store(id, peerChan)
+// connect search the peer and connect to it
+func (e *Engine) connect(ctx context.Context, id peer.ID) error {
+	if e.host.Network().Connectedness(id) == network.Connected {
+		return nil
+	}
 
-	go func() {
-		defer e.routeTable.id.Delete(id)
-		e.addConn(peerChan, id)
-	}()
+	// stop searching as soon as connected
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	return nil, errors.New(fmt.Sprintf("unknown dst addr: %s", id))
+	for info := range e.SearchNode(ctx, id) {
+		if err := e.host.Connect(ctx, info); err == nil {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("can't connect to %s", id))
 }
 
-func (e *Engine) addConn(peerChan PacketChan, id string) {
+// dial search the peer and open a vpn stream to it
+func (e *Engine) dial(ctx context.Context, id string) (network.Stream, error) {
 	e.log.Infof("start find peer %s", id)
 
-	var (
-		stream network.Stream
-		err    error
-	)
-
 	idr, err := base58.Decode(id)
 	if err != nil {
-		e.log.Infof("base58 decode failed: %s", err)
-		return
+		return nil, errors.New(fmt.Sprintf("base58 decode failed: %s", err))
 	}
 
-	pch := e.SearchNode(e.ctx, peer.ID(idr))
-	for info := range pch {
-		err := e.host.Connect(e.ctx, info)
-		if err != nil {
-			continue
-		}
-
-		stream, err = e.host.NewStream(e.ctx, info.ID, VPNStreamProtocol)
-		if err != nil || stream == nil {
-			continue
-		}
-		break
+	// a relayed connection is used if no direct connection can be made
+	if err := e.connect(ctx, peer.ID(idr)); err != nil && e.host.Network().Connectedness(peer.ID(idr)) != network.Limited {
+		return nil, err
 	}
 
-	if stream == nil {
-		return
+	stream, err := e.host.NewStream(network.WithAllowLimitedConn(ctx, allowLimitedReason), peer.ID(idr), vpnProtocols...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't open stream to %s: %s", id, err))
 	}
 
 	e.log.Infof("successfully connect [%s] by %s", id, stream.Conn().RemoteMultiaddr())
-	defer stream.Close()
-
-	mr := msgio.NewVarintReaderSize(stream, network.MessageSizeMax)
-	mw := msgio.NewVarintWriter(stream)
-
-	go func() {
-		for {
-			msg, err := mr.ReadMsg()
-			if err != nil {
-				e.log.Errorf("Peer [%s] read msg error: %s", id, err)
-				return
-			}
-
-			payload := e.payloadPool.Get()
-			payload.Data = e.bufferPool.Get(len(msg))
-			copy(payload.Data, msg)
-			mr.ReleaseMsg(msg)
-			e.devWriter <- payload
-		}
-	}()
-
-	for {
-		select {
-		case payload := <-peerChan:
-			err := mw.WriteMsg(payload.Data)
-			e.bufferPool.Put(payload.Data)
-			e.payloadPool.Put(payload)
-			if err != nil {
-				e.log.Errorf("Peer [%s] write msg error: %s", id, err)
-				return
-			}
-		}
-	}
+	return stream, nil
 }
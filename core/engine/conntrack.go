@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/wlynxg/NetHive/core/firewall"
+	"github.com/wlynxg/NetHive/core/protocol"
+)
+
+const (
+	ConnTrackExpireInterval = 30 * time.Second
+)
+
+type FlowStatus struct {
+	Protocol string
+	Src      netip.AddrPort
+	Dst      netip.AddrPort
+	PeerID   string
+	// Direction is "out" if the flow is started by this node, otherwise "in"
+	Direction    string
+	State        string
+	OrigPackets  uint64
+	OrigBytes    uint64
+	ReplyPackets uint64
+	ReplyBytes   uint64
+	Created      time.Time
+	Expires      time.Time
+}
+
+// filter report whether the firewall allows the packet exchanged with peer id,
+// a stateful firewall tracks the flow of the packet and always allows its replies
+func (e *Engine) filter(id string, direction firewall.Direction, ip protocol.IP, size int) bool {
+	fw := e.firewall.Load()
+	if !fw.Stateful() {
+		return fw.Allow(id, direction, ip)
+	}
+	return e.conntrack.Track(ip, size, direction == firewall.Outbound, id, func() bool {
+		return fw.Allow(id, direction, ip)
+	})
+}
+
+// conntrackLoop remove expired flows periodically
+func (e *Engine) conntrackLoop() {
+	ticker := time.NewTicker(ConnTrackExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := e.conntrack.Expire(now); n > 0 {
+				e.log.Debugf("expire %d flows", n)
+			}
+		}
+	}
+}
+
+// Flows return the flows tracked by the stateful firewall, sorted by creation time
+func (e *Engine) Flows() []FlowStatus {
+	flows := e.conntrack.Flows()
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Created.Before(flows[j].Created) })
+
+	list := make([]FlowStatus, 0, len(flows))
+	for _, f := range flows {
+		direction := "in"
+		if f.Outbound {
+			direction = "out"
+		}
+		list = append(list, FlowStatus{
+			Protocol:     protocolName(f.Protocol),
+			Src:          f.Src,
+			Dst:          f.Dst,
+			PeerID:       f.Peer,
+			Direction:    direction,
+			State:        f.State.String(),
+			OrigPackets:  f.OrigPackets,
+			OrigBytes:    f.OrigBytes,
+			ReplyPackets: f.ReplyPackets,
+			ReplyBytes:   f.ReplyBytes,
+			Created:      f.Created,
+			Expires:      f.Expires,
+		})
+	}
+	return list
+}
+
+func protocolName(p uint8) string {
+	switch p {
+	case protocol.ProtocolTCP:
+		return "tcp"
+	case protocol.ProtocolUDP:
+		return "udp"
+	case protocol.ProtocolICMP:
+		return "icmp"
+	case protocol.ProtocolICMPv6:
+		return "icmpv6"
+	}
+	return "unknown"
+}
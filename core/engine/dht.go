@@ -1,28 +1,61 @@
 package engine
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/libp2p/go-libp2p/p2p/discovery/util"
 	"github.com/pkg/errors"
+	"github.com/wlynxg/NetHive/core/config"
 )
 
 const (
 	DHTRetryInterval = 5 * time.Minute
+
+	discoveryDomain = "NetHive/discovery:"
 )
 
-func (e *Engine) EnableDHT() error {
-	var err error
-	// init dht serve
-	e.dht, err = dht.New(e.ctx, e.host)
-	if err != nil {
-		return err
+// discoveryNamespace return the DHT namespace advertised by the nodes of the network, it's a hash
+// of the secret, so outsiders can't find the members. It's empty if no secret is configured.
+func (e *Engine) discoveryNamespace() string {
+	secret := e.cfg.DiscoverySecret
+	if secret == "" {
+		secret = e.cfg.PrivateNetworkKey
+	}
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(discoveryDomain + secret))
+	return "/NetHive/" + hex.EncodeToString(sum[:])
+}
+
+// newDHT create the DHT of the node. The private DHT speaks its own protocol, so it never mixes
+// with the public IPFS DHT, and its routing table is filled from Bootstraps only.
+func (e *Engine) newDHT() (*dht.IpfsDHT, error) {
+	var options []dht.Option
+	if e.cfg.DHTServer {
+		options = append(options, dht.Mode(dht.ModeServer))
 	}
-	e.discovery = routing.NewRoutingDiscovery(e.dht)
 
+	if e.cfg.DHTMode == config.DHTModePrivate {
+		var bootstraps []peer.AddrInfo
+		for _, s := range e.cfg.Bootstraps {
+			if info, err := peer.AddrInfoFromString(s); err == nil {
+				bootstraps = append(bootstraps, *info)
+			}
+		}
+		options = append(options, dht.ProtocolPrefix(config.DHTProtocolPrefix), dht.BootstrapPeers(bootstraps...))
+		if !e.cfg.DHTServer {
+			options = append(options, dht.Mode(dht.ModeClient))
+		}
+	}
+	return dht.New(e.ctx, e.host, options...)
+}
+
+func (e *Engine) EnableDHT() error {
 	// init DHT
 	if err := e.dht.Bootstrap(e.ctx); err != nil {
 		return err
@@ -41,8 +74,10 @@ func (e *Engine) connectBootstrapsLoop() {
 			e.log.Warnf("fail to connect to DHT for the %dth time: %v", i, err)
 		} else {
 			e.log.Infof("successfully connect DHT!")
-			// advertise node info
-			util.Advertise(e.ctx, e.discovery, e.host.ID().String())
+			// the peer ID is found by DHT peer routing, only the secret namespace is advertised
+			if ns := e.discoveryNamespace(); ns != "" {
+				util.Advertise(e.ctx, e.discovery, ns)
+			}
 			return
 		}
 
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	SessionMigrateTimeout = 30 * time.Second
+	// SessionDrainTimeout limits how long a replaced stream is read for the packets in flight
+	SessionDrainTimeout = 10 * time.Second
+)
+
+type PathType int
+
+const (
+	PathNone PathType = iota
+	PathDirect
+	PathRelayed
+)
+
+func (p PathType) String() string {
+	switch p {
+	case PathDirect:
+		return "direct"
+	case PathRelayed:
+		return "relayed"
+	}
+	return "none"
+}
+
+// isRelayed report whether conn goes through a relay circuit
+func isRelayed(conn network.Conn) bool {
+	if conn.Stat().Limited {
+		return true
+	}
+	_, err := conn.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// enableDirectUpgrade move sessions off relays as soon as a direct connection,
+// usually punched by DCUtR, to the same peer appears
+func (e *Engine) enableDirectUpgrade() {
+	e.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			if isRelayed(conn) {
+				return
+			}
+			if s, ok := e.routeTable.id.Load(conn.RemotePeer().String()); ok {
+				go s.upgrade()
+			}
+		},
+	})
+}
+
+// Path return the type of the connection carrying the session
+func (s *PeerSession) Path() PathType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stream == nil {
+		return PathNone
+	}
+	if isRelayed(s.stream.Conn()) {
+		return PathRelayed
+	}
+	return PathDirect
+}
+
+// upgrade open a stream on the direct connection and hand it over to the session. Only the
+// peer which opened the relayed stream migrates, the other peer takes the new stream as a
+// replacement of the old one, so both peers always agree on the stream in use.
+func (s *PeerSession) upgrade() {
+	s.mu.Lock()
+	stream := s.stream
+	s.mu.Unlock()
+	if stream == nil || !isRelayed(stream.Conn()) || stream.Stat().Direction != network.DirOutbound {
+		return
+	}
+	if !s.migrating.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.migrating.Store(false)
+
+	pid, err := peer.Decode(s.id)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, SessionMigrateTimeout)
+	defer cancel()
+
+	next, err := s.e.host.NewStream(ctx, pid, vpnProtocols...)
+	if err != nil {
+		s.e.log.Debugf("session [%s] fail to open direct stream: %v", s.id, err)
+		return
+	}
+	if isRelayed(next.Conn()) {
+		next.Reset()
+		return
+	}
+
+	select {
+	case s.migrate <- next:
+	case <-s.ctx.Done():
+		next.Reset()
+	}
+}
+
+// drain stop writing to a replaced stream, the packets in flight are still delivered
+// by its reader until the peer closes its side too
+func drain(stream network.Stream, readErr <-chan error) {
+	stream.CloseWrite()
+	stream.SetReadDeadline(time.Now().Add(SessionDrainTimeout))
+	go func() {
+		<-readErr
+		stream.Close()
+	}()
+}
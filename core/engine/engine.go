@@ -2,15 +2,20 @@ package engine
 
 import (
 	"context"
+	"crypto/sha256"
 	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pool "github.com/libp2p/go-buffer-pool"
-	"github.com/libp2p/go-msgio"
 	"github.com/wlynxg/NetHive/core/route"
+	"github.com/wlynxg/NetHive/core/stack"
 	"github.com/wlynxg/NetHive/pkgs/xpool"
 
 	"github.com/wlynxg/NetHive/core/config"
 	"github.com/wlynxg/NetHive/core/device"
+	"github.com/wlynxg/NetHive/core/firewall"
 	mlog "github.com/wlynxg/NetHive/pkgs/log"
 	"github.com/wlynxg/NetHive/pkgs/xsync"
 
@@ -27,6 +32,14 @@ const (
 	BuffSize          = 1500
 	ChanSize          = 15000
 	VPNStreamProtocol = "/NetHive/vpn"
+	// VPNBatchStreamProtocol carries several packets in one message, peers that
+	// don't support it fall back to VPNStreamProtocol during negotiation
+	VPNBatchStreamProtocol = "/NetHive/vpn/batch/1.0.0"
+)
+
+var (
+	// PrivateListenAddrs are used in private network, QUIC and WebRTC can't be protected by the key
+	PrivateListenAddrs = []string{"/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"}
 )
 
 type PacketChan chan *Payload
@@ -45,18 +58,56 @@ type Engine struct {
 	mdns      mdns.Service
 
 	relayChan chan peer.AddrInfo
-
-	devWriter PacketChan
-	devReader PacketChan
+	// relays configured by user, they can be replaced by Reload if relaySource is set
+	relays      atomic.Pointer[[]peer.AddrInfo]
+	relaySource bool
+	reloadMu    sync.Mutex
+
+	// one writer and one reader channel for each queue of the device
+	devWriter []PacketChan
+	devReader []PacketChan
 	errChan   chan error
+	// packets dropped before reaching a session
+	dropped atomic.Uint64
+	// nil if the ACL allows everything
+	firewall  atomic.Pointer[firewall.Firewall]
+	conntrack *stack.ConnTrack
+
+	ipam       ipamState
+	announce   announceState
+	gossip     gossipState
+	membership membershipState
+	magicDNS   magicDNSState
+	// traffic of sessions on limited relayed connections
+	relayUsage xsync.Map[network.Conn, *connUsage]
+	// PeerID derived IPv6 address of this node
+	addr6 netip.Addr
+
+	// exit node used by this node
+	exit struct {
+		dev       string
+		gw        netip.Addr
+		gwDev     string
+		installed atomic.Bool
+		bypass    xsync.Map[netip.Addr, struct{}]
+	}
+
+	// functions to restore the system when the engine exits
+	cleanups   []func()
+	forwarding map[string]bool
 
 	bufferPool  *pool.BufferPool
 	payloadPool xpool.Pool[*Payload]
 
 	routeTable struct {
-		m    xsync.Map[string, netip.Prefix]
-		id   xsync.Map[string, PacketChan]
-		addr xsync.Map[netip.Addr, PacketChan]
+		m      xsync.Map[string, netip.Prefix]
+		id     xsync.Map[string, *PeerSession]
+		prefix *route.Table
+		// kernel routes installed for peer prefixes
+		kernel xsync.Map[netip.Prefix, struct{}]
+		// PeerID derived IPv6 addresses of known peers
+		addr6 xsync.Map[netip.Addr, string]
+		miss6 xsync.Map[netip.Addr, time.Time]
 	}
 }
 
@@ -71,56 +122,51 @@ func Run(ctx context.Context, cfg *config.Config) (*Engine, error) {
 	mlog.SetOutputTypes(cfg.LogConfigs...)
 	e.log = mlog.New("engine")
 	e.ctx, e.cancel = context.WithCancel(ctx)
-	e.devWriter = make(PacketChan, ChanSize)
-	e.devReader = make(PacketChan, ChanSize)
+
+	e.routeTable.prefix = route.NewTable()
+	e.errChan = make(chan error, 1)
+	e.forwarding = make(map[string]bool)
+	e.ipam.claims = make(map[string]*AddressClaim)
+	e.announce.peers = make(map[string]*RouteAnnouncement)
+	e.gossip.handlers = make(map[string]gossipHandler)
+	e.gossip.seen = make(map[[sha256.Size]byte]time.Time)
+	e.membership.seq = make(map[string]int64)
+	e.membership.lastSeen = make(map[string]time.Time)
 
 	e.bufferPool = &pool.BufferPool{}
 	e.payloadPool = xpool.New[*Payload](func() *Payload {
 		return &Payload{}
 	})
 
+	fw, err := firewall.New(cfg.ACL)
+	if err != nil {
+		return nil, err
+	}
+	e.firewall.Store(fw)
+	e.conntrack = stack.NewConnTrack()
+
 	pk, err := cfg.PrivateKey.PrivKey()
 	if err != nil {
 		return nil, err
 	}
-	options = append(options, libp2p.Identity(pk))
-
-	if len(cfg.Relays) > 0 {
-		var relays []peer.AddrInfo
-		for _, relay := range cfg.Relays {
-			addrInfo, err := peer.AddrInfoFromString(relay)
-			if err != nil {
-				e.log.Warnf("fail to parse '%s': %v", relay, err)
-				continue
-			}
-			relays = append(relays, *addrInfo)
-		}
-		options = append(options, libp2p.EnableAutoRelayWithStaticRelays(relays))
-	} else if cfg.EnableAutoRelay {
+	options = append(options, libp2p.Identity(pk), libp2p.EnableHolePunching())
+
+	psk, err := cfg.PSK()
+	if err != nil {
+		return nil, err
+	}
+	if psk != nil {
+		// only TCP based transports support private network
+		options = append(options, libp2p.PrivateNetwork(psk), libp2p.ListenAddrStrings(PrivateListenAddrs...))
+	}
+
+	e.relays.Store(parseRelays(e.log, cfg.Relays))
+	if len(cfg.Relays) == 0 && cfg.EnableAutoRelay {
 		e.relayChan = make(chan peer.AddrInfo, ChanSize)
-		options = append(options, libp2p.EnableAutoRelayWithPeerSource(func(ctx context.Context, num int) <-chan peer.AddrInfo {
-			c := make(chan peer.AddrInfo, num)
-			go func() {
-				defer close(c)
-				for ; num >= 0; num-- {
-					select {
-					case v, ok := <-e.relayChan:
-						if !ok {
-							return
-						}
-						e.log.Debugf("auto relay find node: %v", v)
-						select {
-						case c <- v:
-						case <-ctx.Done():
-							return
-						}
-					case <-ctx.Done():
-						return
-					}
-				}
-			}()
-			return c
-		}))
+	}
+	if len(cfg.Relays) > 0 || cfg.EnableAutoRelay {
+		e.relaySource = true
+		options = append(options, libp2p.EnableAutoRelayWithPeerSource(e.relayPeerSource))
 	}
 
 	node, err := libp2p.New(options...)
@@ -130,7 +176,7 @@ func Run(ctx context.Context, cfg *config.Config) (*Engine, error) {
 
 	e.host = node
 	e.log.Infof("host ID: %s", node.ID().String())
-	e.dht, err = dht.New(e.ctx, e.host)
+	e.dht, err = e.newDHT()
 	if err != nil {
 		return nil, err
 	}
@@ -142,12 +188,27 @@ func Run(ctx context.Context, cfg *config.Config) (*Engine, error) {
 func (e *Engine) Run() error {
 	var err error
 	defer e.cancel()
+	defer e.cleanup()
+
+	if err := e.initIPAM(); err != nil {
+		return err
+	}
 
 	// TUN init
-	e.device, err = device.CreateTUN(e.cfg.TUNName, e.cfg.MTU)
+	e.device, err = device.CreateTUN(e.cfg.TUNName, e.cfg.MTU, e.cfg.TUNQueues)
 	if err != nil {
 		return err
 	}
+	e.addCleanup(func() { e.device.Close() })
+	e.addCleanup(e.delPeerRoutes)
+
+	queues := e.device.Queues()
+	e.devWriter = make([]PacketChan, len(queues))
+	e.devReader = make([]PacketChan, len(queues))
+	for i := range queues {
+		e.devWriter[i] = make(PacketChan, ChanSize)
+		e.devReader[i] = make(PacketChan, ChanSize)
+	}
 
 	name, err := e.device.Name()
 	if err != nil {
@@ -163,14 +224,42 @@ func (e *Engine) Run() error {
 	}
 
 	for id, prefix := range e.cfg.PeersRouteTable {
+		prefix = peerPrefix(prefix)
 		e.routeTable.m.Store(id, prefix)
+		e.addPeerPrefix(name, id, prefix)
+	}
+
+	for _, id := range e.cfg.TrustedPeers {
+		// trusted peers announce their prefixes by themselves
+		e.routeTable.m.LoadOrStore(id, netip.Prefix{})
+	}
 
-		err := route.Add(name, prefix)
-		if err != nil {
-			e.log.Warnf("fail to add %s's route %s: %v", id, prefix, err)
-			continue
+	for id, prefixes := range e.cfg.PeersSubnets {
+		// peers only routing subnets are members as well
+		e.routeTable.m.LoadOrStore(id, netip.Prefix{})
+		for _, prefix := range prefixes {
+			e.addPeerPrefix(name, id, prefix.Masked())
 		}
-		e.log.Debugf("successfully add %s's route: %s", id, prefix)
+	}
+
+	if err := e.enableOverlay6(); err != nil {
+		return err
+	}
+
+	if err := e.enableMagicDNS(name); err != nil {
+		return err
+	}
+
+	if err := e.enableSubnetRouter(name); err != nil {
+		return err
+	}
+
+	if err := e.enableExitNode(name); err != nil {
+		return err
+	}
+
+	if err := e.useExitNode(name); err != nil {
+		return err
 	}
 
 	if len(e.cfg.Bootstraps) > 0 {
@@ -190,64 +279,108 @@ func (e *Engine) Run() error {
 		go e.autoRelayFinder(e.ctx)
 	}
 
+	e.host.SetStreamHandler(IPAMProtocol, e.IPAMHandler)
+	go e.ipamLoop()
+
+	e.host.SetStreamHandler(RoutesProtocol, e.RoutesHandler)
+	go e.announceLoop()
+
+	if err := e.enableMembership(); err != nil {
+		return err
+	}
+
+	go e.conntrackLoop()
+	e.enableDirectUpgrade()
+	e.enableRelayUsage()
+	go e.pathLoop()
+
+	e.host.SetStreamHandler(VPNBatchStreamProtocol, e.VPNHandler)
 	e.host.SetStreamHandler(VPNStreamProtocol, e.VPNHandler)
 
-	go e.RoutineTUNReader()
-	go e.RoutineTUNWriter()
-	go e.RoutineRouteTableWriter()
+	for i, q := range queues {
+		go e.RoutineTUNReader(q, e.devReader[i])
+		go e.RoutineTUNWriter(q, e.devWriter[i])
+		go e.RoutineRouteTableWriter(e.devReader[i])
+	}
+	e.log.Infof("%s running with %d queues", name, len(queues))
 
 	e.log.Infof("listen addrs: %s", e.host.Addrs())
 	e.log.Infof("protocol handles: %s", e.host.Mux().Protocols())
 
-	if err := <-e.errChan; err != nil {
+	select {
+	case err := <-e.errChan:
 		return err
+	case <-e.ctx.Done():
+		return nil
 	}
-	return nil
 }
 
-func (e *Engine) VPNHandler(stream network.Stream) {
-	e.log.Debugf("[%s] connect by %s", stream.Conn().RemotePeer(), stream.Conn().RemoteMultiaddr())
+// addPeerPrefix route prefix to peer id in both route table and kernel
+func (e *Engine) addPeerPrefix(dev, id string, prefix netip.Prefix) error {
+	if err := e.routeTable.prefix.Add(prefix, id); err != nil {
+		e.log.Warnf("fail to add %s's prefix %s to route table: %v", id, prefix, err)
+		return err
+	}
 
-	id := stream.Conn().RemotePeer().String()
-	if _, ok := e.routeTable.m.Load(id); !ok {
-		stream.Close()
+	if _, ok := e.routeTable.kernel.Load(prefix); ok {
+		return nil
+	}
+	if err := route.Add(dev, prefix); err != nil {
+		e.log.Warnf("fail to add %s's route %s: %v", id, prefix, err)
+		return err
+	}
+	e.routeTable.kernel.Store(prefix, struct{}{})
+	e.log.Debugf("successfully add %s's route: %s", id, prefix)
+	return nil
+}
+
+// delPeerRoute remove the kernel route of a peer prefix
+func (e *Engine) delPeerRoute(prefix netip.Prefix) {
+	if _, ok := e.routeTable.kernel.LoadAndDelete(prefix); !ok {
 		return
 	}
+	if err := route.Del(prefix); err != nil {
+		e.log.Warnf("fail to delete route %s: %v", prefix, err)
+	}
+}
 
-	mr := msgio.NewVarintReaderSize(stream, network.MessageSizeMax)
-	mw := msgio.NewVarintWriter(stream)
+// delPeerRoutes remove all kernel routes of peer prefixes
+func (e *Engine) delPeerRoutes() {
+	e.routeTable.kernel.Range(func(prefix netip.Prefix, _ struct{}) bool {
+		e.delPeerRoute(prefix)
+		return true
+	})
+}
 
-	peerChan, ok := e.routeTable.id.Load(id)
-	if !ok {
-		return
+// addCleanup register fn to run when the engine exits
+func (e *Engine) addCleanup(fn func()) {
+	e.cleanups = append(e.cleanups, fn)
+}
+
+// cleanup run the registered functions in reverse order
+func (e *Engine) cleanup() {
+	for i := len(e.cleanups) - 1; i >= 0; i-- {
+		e.cleanups[i]()
 	}
+	e.cleanups = nil
+}
 
-	go func() {
-		for {
-			msg, err := mr.ReadMsg()
-			if err != nil {
-				e.log.Errorf("Peer [%s] read msg error: %s", id, err)
-				return
-			}
+// isMember report whether id is configured or in the member list of the network
+func (e *Engine) isMember(id string) bool {
+	if _, ok := e.routeTable.m.Load(id); ok {
+		return true
+	}
+	return e.IsNetworkMember(id)
+}
 
-			payload := e.payloadPool.Get()
-			payload.Data = e.bufferPool.Get(len(msg))
-			copy(payload.Data, msg)
-			mr.ReleaseMsg(msg)
-			e.devWriter <- payload
-		}
-	}()
-
-	for {
-		select {
-		case payload := <-peerChan:
-			err := mw.WriteMsg(payload.Data)
-			e.bufferPool.Put(payload.Data)
-			e.payloadPool.Put(payload)
-			if err != nil {
-				e.log.Errorf("Peer [%s] write msg error: %s", id, err)
-				continue
-			}
-		}
+func (e *Engine) VPNHandler(stream network.Stream) {
+	e.log.Debugf("[%s] connect by %s", stream.Conn().RemotePeer(), stream.Conn().RemoteMultiaddr())
+
+	id := stream.Conn().RemotePeer().String()
+	if !e.isMember(id) && !e.cfg.EnableOverlayIPv6 {
+		stream.Close()
+		return
 	}
+
+	e.session(id, stream)
 }
@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/wlynxg/NetHive/core/route"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ExitRouteCheckInterval = time.Second
+)
+
+var (
+	// DefaultRoute4 is routed to the exit node in route table
+	DefaultRoute4 = netip.MustParsePrefix("0.0.0.0/0")
+	// the default route is installed into kernel as two halves, so it takes
+	// precedence over the original default route without replacing it
+	exitSplitRoutes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/1"),
+		netip.MustParsePrefix("128.0.0.0/1"),
+	}
+)
+
+// enableExitNode make this node an exit node, traffic from the overlay to the internet is masqueraded
+func (e *Engine) enableExitNode(dev string) error {
+	if !e.cfg.AdvertiseExitNode {
+		return nil
+	}
+
+	if err := e.enableIPForward(dev, false); err != nil {
+		return err
+	}
+	if err := e.masquerade(e.cfg.LocalAddr.Masked(), DefaultRoute4); err != nil {
+		return err
+	}
+	e.log.Infof("running as exit node")
+	return nil
+}
+
+// useExitNode send all IPv4 internet traffic through the exit node. Underlay addresses of
+// bootstraps, relays and peers keep using the original default gateway, so that libp2p
+// never routes over itself.
+func (e *Engine) useExitNode(dev string) error {
+	id := e.cfg.ExitNode
+	if id == "" {
+		return nil
+	}
+	if _, err := peer.Decode(id); err != nil {
+		return err
+	}
+
+	def, err := route.Default(unix.AF_INET)
+	if err != nil {
+		return err
+	}
+	gw, gwDev := def.Gateway, def.Dev
+	e.exit.dev, e.exit.gw, e.exit.gwDev = dev, gw, gwDev
+
+	e.routeTable.m.LoadOrStore(id, netip.Prefix{})
+	if err := e.routeTable.prefix.Add(DefaultRoute4, id); err != nil {
+		return err
+	}
+
+	for _, s := range append(e.cfg.Bootstraps, e.cfg.Relays...) {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			continue
+		}
+		for _, addr := range info.Addrs {
+			e.bypass(addr)
+		}
+	}
+	for _, conn := range e.host.Network().Conns() {
+		e.bypassConn(conn)
+	}
+	e.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) { e.bypassConn(conn) },
+	})
+
+	e.addCleanup(func() {
+		e.removeExitRoutes()
+		e.exit.bypass.Range(func(key netip.Addr, _ struct{}) bool {
+			route.DelRoute(route.Route{Dst: netip.PrefixFrom(key, key.BitLen()), Gateway: e.exit.gw, Dev: e.exit.gwDev})
+			return true
+		})
+	})
+
+	e.session(id, nil)
+	go e.exitRouteLoop(id)
+	e.log.Infof("use exit node %s, original default route via %s dev %s", id, gw, gwDev)
+	return nil
+}
+
+// exitRouteLoop install the split default routes only while the session to the exit node
+// is working, otherwise searching the exit node itself would be routed into the tunnel
+func (e *Engine) exitRouteLoop(id string) {
+	ticker := time.NewTicker(ExitRouteCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		state, _ := e.SessionState(id)
+		if state.Working() && !e.exit.installed.Load() {
+			pid, _ := peer.Decode(id)
+			for _, conn := range e.host.Network().ConnsToPeer(pid) {
+				e.bypass(conn.RemoteMultiaddr())
+			}
+			e.installExitRoutes()
+		} else if !state.Working() && e.exit.installed.Load() {
+			e.log.Warnf("exit node %s is %s, internet traffic bypasses the tunnel", id, state)
+			e.removeExitRoutes()
+		}
+	}
+}
+
+func (e *Engine) installExitRoutes() {
+	for _, prefix := range exitSplitRoutes {
+		if err := route.Add(e.exit.dev, prefix); err != nil {
+			e.log.Warnf("fail to add exit route %s: %v", prefix, err)
+		}
+	}
+	e.exit.installed.Store(true)
+	e.log.Infof("internet traffic is routed through exit node %s", e.cfg.ExitNode)
+}
+
+func (e *Engine) removeExitRoutes() {
+	if !e.exit.installed.Swap(false) {
+		return
+	}
+	for _, prefix := range exitSplitRoutes {
+		if err := route.Del(prefix); err != nil {
+			e.log.Warnf("fail to delete exit route %s: %v", prefix, err)
+		}
+	}
+}
+
+// bypassConn keep the connection out of the tunnel unless it was dialed through the tunnel
+func (e *Engine) bypassConn(conn network.Conn) {
+	if conn.Stat().Direction != network.DirInbound {
+		local, err := addrFromMultiaddr(conn.LocalMultiaddr())
+		if err != nil || local.IsUnspecified() || e.cfg.LocalAddr.Contains(local) {
+			return
+		}
+	}
+	e.bypass(conn.RemoteMultiaddr())
+}
+
+// bypass add a host route to the underlay address through the original default gateway
+func (e *Engine) bypass(addr ma.Multiaddr) {
+	ip, err := addrFromMultiaddr(addr)
+	if err != nil || !ip.Is4() || ip.IsLoopback() || ip.IsUnspecified() || e.cfg.LocalAddr.Contains(ip) {
+		return
+	}
+	if prefix, _, ok := e.routeTable.prefix.Lookup(ip); ok && prefix != DefaultRoute4 {
+		return
+	}
+	if _, loaded := e.exit.bypass.LoadOrStore(ip, struct{}{}); loaded {
+		return
+	}
+
+	// only addresses which are routed by the default route need a host route,
+	// on-link addresses and more specific routes are left untouched
+	r, err := route.Get(ip)
+	if err != nil || (r.Dev != e.exit.dev && (r.Gateway != e.exit.gw || r.Dev != e.exit.gwDev)) {
+		e.exit.bypass.Delete(ip)
+		return
+	}
+
+	err = route.ReplaceRoute(route.Route{Dst: netip.PrefixFrom(ip, 32), Gateway: e.exit.gw, Dev: e.exit.gwDev})
+	if err != nil {
+		e.log.Warnf("fail to add bypass route of %s: %v", ip, err)
+		e.exit.bypass.Delete(ip)
+		return
+	}
+	e.log.Debugf("add bypass route of %s via %s dev %s", ip, e.exit.gw, e.exit.gwDev)
+}
+
+// addrFromMultiaddr return the IP address of the first component of addr
+func addrFromMultiaddr(addr ma.Multiaddr) (netip.Addr, error) {
+	if v, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		return netip.ParseAddr(v)
+	}
+	v, err := addr.ValueForProtocol(ma.P_IP6)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(v)
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-msgio"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BatchMaxSize is the size at which a batch frame is flushed immediately
+	BatchMaxSize = 32 * 1024
+	// BatchFlushInterval is the longest time a packet waits in a batch frame
+	BatchFlushInterval = time.Millisecond
+)
+
+var (
+	ErrInvalidBatch = errors.New("invalid batch frame")
+)
+
+// packetReader read packets from a vpn stream
+type packetReader interface {
+	// ReadPackets read the next message from stream and call fn for every packet in it,
+	// the packet is only valid during the call of fn
+	ReadPackets(fn func(packet []byte)) error
+}
+
+// packetWriter write packets to a vpn stream
+type packetWriter interface {
+	// WritePacket write a packet to stream, the packet may be buffered until Flush
+	WritePacket(packet []byte) error
+	// Flush write all buffered packets to stream
+	Flush() error
+	// Buffered return the number of buffered bytes
+	Buffered() int
+}
+
+// newPacketReader create a packetReader according to the framing negotiated by stream
+func newPacketReader(stream network.Stream) packetReader {
+	mr := msgio.NewVarintReaderSize(stream, network.MessageSizeMax)
+	if stream.Protocol() == VPNBatchStreamProtocol {
+		return &batchReader{mr: mr}
+	}
+	return &singleReader{mr: mr}
+}
+
+// newPacketWriter create a packetWriter according to the framing negotiated by stream
+func newPacketWriter(stream network.Stream) packetWriter {
+	mw := msgio.NewVarintWriter(stream)
+	if stream.Protocol() == VPNBatchStreamProtocol {
+		return &batchWriter{mw: mw, buff: make([]byte, 0, BatchMaxSize+BuffSize+binary.MaxVarintLen64)}
+	}
+	return &singleWriter{mw: mw}
+}
+
+// singleReader read the framing of VPNStreamProtocol, one message contains one packet
+type singleReader struct {
+	mr msgio.ReadCloser
+}
+
+func (r *singleReader) ReadPackets(fn func(packet []byte)) error {
+	msg, err := r.mr.ReadMsg()
+	if err != nil {
+		return err
+	}
+	fn(msg)
+	r.mr.ReleaseMsg(msg)
+	return nil
+}
+
+// singleWriter write the framing of VPNStreamProtocol, one message contains one packet
+type singleWriter struct {
+	mw msgio.WriteCloser
+}
+
+func (w *singleWriter) WritePacket(packet []byte) error { return w.mw.WriteMsg(packet) }
+func (w *singleWriter) Flush() error                    { return nil }
+func (w *singleWriter) Buffered() int                   { return 0 }
+
+// batchReader read the framing of VPNBatchStreamProtocol,
+// one message contains several packets, each prefixed with its uvarint length
+type batchReader struct {
+	mr msgio.ReadCloser
+}
+
+func (r *batchReader) ReadPackets(fn func(packet []byte)) error {
+	msg, err := r.mr.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer r.mr.ReleaseMsg(msg)
+
+	for buff := msg; len(buff) > 0; {
+		size, n := binary.Uvarint(buff)
+		if n <= 0 || size > uint64(len(buff)-n) {
+			return ErrInvalidBatch
+		}
+		buff = buff[n:]
+		fn(buff[:size])
+		buff = buff[size:]
+	}
+	return nil
+}
+
+// batchWriter write the framing of VPNBatchStreamProtocol
+type batchWriter struct {
+	mw   msgio.WriteCloser
+	buff []byte
+}
+
+func (w *batchWriter) WritePacket(packet []byte) error {
+	w.buff = binary.AppendUvarint(w.buff, uint64(len(packet)))
+	w.buff = append(w.buff, packet...)
+	if len(w.buff) >= BatchMaxSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+func (w *batchWriter) Flush() error {
+	if len(w.buff) == 0 {
+		return nil
+	}
+	err := w.mw.WriteMsg(w.buff)
+	w.buff = w.buff[:0]
+	return err
+}
+
+func (w *batchWriter) Buffered() int { return len(w.buff) }
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-msgio"
+)
+
+func TestBatchFrame(t *testing.T) {
+	var stream bytes.Buffer
+	w := &batchWriter{mw: msgio.NewVarintWriter(&stream)}
+	packets := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 300), {}, []byte("cd")}
+	for _, p := range packets {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Buffered() != 0 {
+		t.Fatalf("w.Buffered() = %d, want 0", w.Buffered())
+	}
+
+	r := &batchReader{mr: msgio.NewVarintReaderSize(&stream, network.MessageSizeMax)}
+	var got [][]byte
+	err := r.ReadPackets(func(packet []byte) {
+		got = append(got, append([]byte{}, packet...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("read %d packets, want %d", len(got), len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Errorf("packet[%d] = %v, want %v", i, got[i], packets[i])
+		}
+	}
+}
+
+func TestBatchFrameInvalid(t *testing.T) {
+	var stream bytes.Buffer
+	msgio.NewVarintWriter(&stream).WriteMsg([]byte{10, 1, 2})
+
+	r := &batchReader{mr: msgio.NewVarintReaderSize(&stream, network.MessageSizeMax)}
+	if err := r.ReadPackets(func([]byte) {}); err != ErrInvalidBatch {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidBatch)
+	}
+}
@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	GossipProtocol = "/NetHive/gossip/1.0.0"
+	GossipTimeout  = 10 * time.Second
+	// GossipSeenTTL must be longer than a message takes to spread over the network
+	GossipSeenTTL = 2 * time.Minute
+)
+
+// gossipMessage is flooded to every connected peer speaking GossipProtocol,
+// each peer forwards a message at most once
+type gossipMessage struct {
+	Topic string
+	Data  json.RawMessage
+}
+
+// gossipHandler deliver data of a topic, invalid messages return false and are not forwarded
+type gossipHandler func(from peer.ID, data []byte) bool
+
+type gossipState struct {
+	mu       sync.Mutex
+	handlers map[string]gossipHandler
+	seen     map[[sha256.Size]byte]time.Time
+}
+
+func (e *Engine) subscribe(topic string, handler gossipHandler) {
+	e.gossip.mu.Lock()
+	defer e.gossip.mu.Unlock()
+	e.gossip.handlers[topic] = handler
+}
+
+// markSeen report whether msg is new and remember it
+func (e *Engine) markSeen(msg *gossipMessage) bool {
+	id := sha256.Sum256(append([]byte(msg.Topic+"\x00"), msg.Data...))
+
+	e.gossip.mu.Lock()
+	defer e.gossip.mu.Unlock()
+
+	now := time.Now()
+	if t, ok := e.gossip.seen[id]; ok && now.Sub(t) < GossipSeenTTL {
+		return false
+	}
+	e.gossip.seen[id] = now
+	return true
+}
+
+// expireSeen forget messages older than GossipSeenTTL, so that republished messages spread again
+func (e *Engine) expireSeen() {
+	e.gossip.mu.Lock()
+	defer e.gossip.mu.Unlock()
+
+	for id, t := range e.gossip.seen {
+		if time.Since(t) >= GossipSeenTTL {
+			delete(e.gossip.seen, id)
+		}
+	}
+}
+
+// publish send v to all gossip peers on topic
+func (e *Engine) publish(ctx context.Context, topic string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := &gossipMessage{Topic: topic, Data: data}
+	e.markSeen(msg)
+	e.forward(ctx, msg, "")
+	return nil
+}
+
+// forward send msg to all gossip peers except the peer it comes from
+func (e *Engine) forward(ctx context.Context, msg *gossipMessage, from peer.ID) {
+	var wg sync.WaitGroup
+	for _, id := range e.gossipPeers() {
+		if id == from {
+			continue
+		}
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			if err := e.sendGossip(ctx, id, msg); err != nil {
+				e.log.Debugf("fail to send gossip to %s: %v", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+// gossipPeers return the connected peers speaking GossipProtocol
+func (e *Engine) gossipPeers() []peer.ID {
+	var peers []peer.ID
+	for _, id := range e.host.Network().Peers() {
+		if ok, _ := e.host.Peerstore().SupportsProtocols(id, GossipProtocol); len(ok) > 0 {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+func (e *Engine) sendGossip(ctx context.Context, id peer.ID, msg *gossipMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, GossipTimeout)
+	defer cancel()
+
+	stream, err := e.host.NewStream(ctx, id, GossipProtocol)
+	if err != nil {
+		return err
+	}
+	stream.SetDeadline(time.Now().Add(GossipTimeout))
+	if err := writeRecords(stream, msg); err != nil {
+		stream.Reset()
+		return err
+	}
+	return stream.Close()
+}
+
+// GossipHandler deliver a gossip message and forward it if it's new and valid
+func (e *Engine) GossipHandler(stream network.Stream) {
+	defer stream.Close()
+
+	from := stream.Conn().RemotePeer()
+	stream.SetDeadline(time.Now().Add(GossipTimeout))
+	var msg gossipMessage
+	if err := readRecords(stream, &msg); err != nil {
+		e.log.Debugf("fail to read gossip from %s: %v", from, err)
+		stream.Reset()
+		return
+	}
+
+	e.gossip.mu.Lock()
+	handler, ok := e.gossip.handlers[msg.Topic]
+	e.gossip.mu.Unlock()
+	if !ok || !e.markSeen(&msg) {
+		return
+	}
+	if handler(from, msg.Data) {
+		go e.forward(e.ctx, &msg, from)
+	}
+}
@@ -0,0 +1,351 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pkg/errors"
+	"github.com/wlynxg/NetHive/core/config"
+)
+
+const (
+	IPAMProtocol        = "/NetHive/ipam/1.0.0"
+	IPAMExchangeTimeout = 30 * time.Second
+	IPAMInterval        = time.Minute
+
+	ipamSignDomain = "NetHive/ipam:"
+	// maxAllocateAttempts limits the scan of huge address pools
+	maxAllocateAttempts = 1 << 16
+)
+
+// AddressClaim is a signed statement of a peer that it uses Addr as its overlay address.
+// When two peers claim the same address, the older claim wins, ties are broken by peer ID.
+type AddressClaim struct {
+	PeerID    string
+	Addr      netip.Addr
+	ClaimedAt int64
+	Signature []byte
+}
+
+func (c *AddressClaim) signedData() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%d", c.PeerID, c.Addr, c.ClaimedAt))
+}
+
+// beats report whether c has priority over o for the same address
+func (c *AddressClaim) beats(o *AddressClaim) bool {
+	if c.ClaimedAt != o.ClaimedAt {
+		return c.ClaimedAt < o.ClaimedAt
+	}
+	return c.PeerID < o.PeerID
+}
+
+type ipamState struct {
+	mu sync.Mutex
+	// claims is the latest verified claim of every peer, including the local one
+	claims map[string]*AddressClaim
+}
+
+// isAutoAddress report whether LocalAddr is allocated by IPAM
+func (e *Engine) isAutoAddress() bool {
+	return e.cfg.AddressMode == config.AddressModeAuto
+}
+
+// initIPAM claim the local address, a static address is claimed as the oldest claim,
+// so that auto allocated peers always move away from it
+func (e *Engine) initIPAM() error {
+	if e.isAutoAddress() {
+		return e.allocateAddress()
+	}
+
+	e.ipam.mu.Lock()
+	defer e.ipam.mu.Unlock()
+	return e.claimLocked(e.cfg.LocalAddr.Addr(), 0)
+}
+
+// allocateAddress make sure LocalAddr is a valid address of AddressPool claimed by this node,
+// the persisted address is kept across restarts as long as no conflict is found
+func (e *Engine) allocateAddress() error {
+	pool := e.cfg.AddressPool.Masked()
+	if !pool.IsValid() {
+		return errors.New("AddressPool is required in auto address mode")
+	}
+
+	e.ipam.mu.Lock()
+	defer e.ipam.mu.Unlock()
+
+	local := e.cfg.LocalAddr
+	if local.IsValid() && local.Bits() == pool.Bits() && pool.Contains(local.Addr()) && e.cfg.AddressClaimedAt > 0 &&
+		!e.addressTakenLocked(local.Addr()) {
+		return e.claimLocked(local.Addr(), e.cfg.AddressClaimedAt)
+	}
+
+	addr, err := e.freeAddressLocked(pool)
+	if err != nil {
+		return err
+	}
+	return e.claimLocked(addr, time.Now().Unix())
+}
+
+// freeAddressLocked return an address of pool which isn't claimed by other peers,
+// the scan starts at an offset derived from the peer ID to make collisions unlikely
+func (e *Engine) freeAddressLocked(pool netip.Prefix) (netip.Addr, error) {
+	hostBits := pool.Addr().BitLen() - pool.Bits()
+	if hostBits > 63 {
+		hostBits = 63
+	}
+	size := uint64(1) << hostBits
+
+	hash := sha256.Sum256([]byte(e.host.ID()))
+	start := binary.BigEndian.Uint64(hash[:8]) % size
+	for i := uint64(0); i < size && i < maxAllocateAttempts; i++ {
+		n := (start + i) % size
+		// skip the network and broadcast address of IPv4 pools
+		if pool.Addr().Is4() && (n == 0 || n == size-1) && size > 2 {
+			continue
+		}
+
+		addr := nthAddr(pool, n)
+		if !e.addressTakenLocked(addr) {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, errors.Errorf("no free address in %s", pool)
+}
+
+// addressTakenLocked report whether addr is claimed by another peer
+func (e *Engine) addressTakenLocked(addr netip.Addr) bool {
+	self := e.host.ID().String()
+	for id, claim := range e.ipam.claims {
+		if id != self && claim.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// claimLocked sign a claim of addr, in auto address mode the address is applied to the device and config
+func (e *Engine) claimLocked(addr netip.Addr, claimedAt int64) error {
+	claim := &AddressClaim{PeerID: e.host.ID().String(), Addr: addr, ClaimedAt: claimedAt}
+	sig, err := e.signRecord(ipamSignDomain, claim.signedData())
+	if err != nil {
+		return err
+	}
+	claim.Signature = sig
+	e.ipam.claims[claim.PeerID] = claim
+
+	prefix := netip.PrefixFrom(addr, e.cfg.AddressPool.Bits())
+	if !e.isAutoAddress() || (prefix == e.cfg.LocalAddr && claimedAt == e.cfg.AddressClaimedAt) {
+		return nil
+	}
+
+	if e.device != nil {
+		if err := e.device.FlushAddress(); err != nil {
+			return err
+		}
+		if err := e.device.AddAddress(prefix); err != nil {
+			return err
+		}
+	}
+
+	e.log.Infof("claim overlay address %s", prefix)
+	e.cfg.LocalAddr = prefix
+	e.cfg.AddressClaimedAt = claimedAt
+	go e.rebindMagicDNS(addr)
+	return e.cfg.Save()
+}
+
+// mergeClaims verify claims received from peers, install routes of member peers
+// and move the local address away if it loses a conflict
+func (e *Engine) mergeClaims(claims []*AddressClaim) {
+	e.ipam.mu.Lock()
+	defer e.ipam.mu.Unlock()
+
+	self := e.host.ID().String()
+	for _, claim := range claims {
+		if claim.PeerID == self {
+			continue
+		}
+		if old, ok := e.ipam.claims[claim.PeerID]; ok &&
+			(old.ClaimedAt > claim.ClaimedAt || (old.ClaimedAt == claim.ClaimedAt && old.Addr == claim.Addr)) {
+			continue
+		}
+
+		id, err := peer.Decode(claim.PeerID)
+		if err != nil {
+			continue
+		}
+		if err := e.verifyRecord(id, ipamSignDomain, claim.signedData(), claim.Signature); err != nil {
+			e.log.Warnf("drop address claim of %s: %v", claim.PeerID, err)
+			continue
+		}
+
+		old := e.ipam.claims[claim.PeerID]
+		e.ipam.claims[claim.PeerID] = claim
+		e.log.Debugf("peer %s claims %s", claim.PeerID, claim.Addr)
+
+		if _, ok := e.routeTable.m.Load(claim.PeerID); ok {
+			e.routeClaim(old, claim)
+		}
+
+		own := e.ipam.claims[self]
+		if e.isAutoAddress() && own != nil && own.Addr == claim.Addr && claim.beats(own) {
+			e.log.Warnf("address %s is already claimed by %s, allocate a new one", own.Addr, claim.PeerID)
+			addr, err := e.freeAddressLocked(e.cfg.AddressPool.Masked())
+			if err != nil {
+				e.log.Errorf("fail to allocate address: %v", err)
+				continue
+			}
+			if err := e.claimLocked(addr, time.Now().Unix()); err != nil {
+				e.log.Errorf("fail to claim address %s: %v", addr, err)
+			}
+		}
+	}
+}
+
+// routeClaim route the claimed address to the member peer
+func (e *Engine) routeClaim(old, claim *AddressClaim) {
+	name, err := e.device.Name()
+	if err != nil {
+		return
+	}
+
+	if old != nil && old.Addr != claim.Addr {
+		prefix := netip.PrefixFrom(old.Addr, old.Addr.BitLen())
+		if owner, ok := e.routeTable.prefix.Del(prefix); ok && owner == old.PeerID {
+			e.delPeerRoute(prefix)
+		}
+	}
+
+	prefix := netip.PrefixFrom(claim.Addr, claim.Addr.BitLen())
+	e.routeTable.m.Store(claim.PeerID, prefix)
+	e.addPeerPrefix(name, claim.PeerID, prefix)
+}
+
+func (e *Engine) knownClaims() []*AddressClaim {
+	e.ipam.mu.Lock()
+	defer e.ipam.mu.Unlock()
+
+	claims := make([]*AddressClaim, 0, len(e.ipam.claims))
+	for _, claim := range e.ipam.claims {
+		claims = append(claims, claim)
+	}
+	return claims
+}
+
+// IPAMHandler exchange address claims with a member peer
+func (e *Engine) IPAMHandler(stream network.Stream) {
+	defer stream.Close()
+
+	id := stream.Conn().RemotePeer().String()
+	if _, ok := e.routeTable.m.Load(id); !ok {
+		stream.Reset()
+		return
+	}
+
+	stream.SetDeadline(time.Now().Add(IPAMExchangeTimeout))
+	claims, err := readClaims(stream)
+	if err != nil {
+		e.log.Debugf("fail to read address claims from %s: %v", id, err)
+		stream.Reset()
+		return
+	}
+	if err := writeClaims(stream, e.knownClaims()); err != nil {
+		e.log.Debugf("fail to write address claims to %s: %v", id, err)
+		stream.Reset()
+		return
+	}
+	e.mergeClaims(claims)
+}
+
+// ipamLoop exchange address claims with member peers periodically, a node with
+// static address only talks to connected peers, while an auto allocated node has
+// to reach every member to learn their addresses
+func (e *Engine) ipamLoop() {
+	ticker := time.NewTicker(IPAMInterval)
+	defer ticker.Stop()
+
+	for {
+		e.routeTable.m.Range(func(key string, _ netip.Prefix) bool {
+			if !e.isAutoAddress() {
+				if id, err := peer.Decode(key); err != nil || e.host.Network().Connectedness(id) != network.Connected {
+					return true
+				}
+			}
+			go func(id string) {
+				if err := e.exchangeClaims(id); err != nil {
+					e.log.Debugf("fail to exchange address claims with %s: %v", id, err)
+				}
+			}(key)
+			return true
+		})
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Engine) exchangeClaims(id string) error {
+	ctx, cancel := context.WithTimeout(e.ctx, IPAMExchangeTimeout)
+	defer cancel()
+
+	pid, err := peer.Decode(id)
+	if err != nil {
+		return err
+	}
+	if err := e.connect(ctx, pid); err != nil {
+		return err
+	}
+
+	stream, err := e.host.NewStream(ctx, pid, IPAMProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(IPAMExchangeTimeout))
+	if err := writeClaims(stream, e.knownClaims()); err != nil {
+		stream.Reset()
+		return err
+	}
+	claims, err := readClaims(stream)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	e.mergeClaims(claims)
+	return nil
+}
+
+func readClaims(stream network.Stream) ([]*AddressClaim, error) {
+	var claims []*AddressClaim
+	if err := readRecords(stream, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func writeClaims(stream network.Stream, claims []*AddressClaim) error {
+	return writeRecords(stream, claims)
+}
+
+// nthAddr return the nth address of prefix, n must fit in the host bits
+func nthAddr(prefix netip.Prefix, n uint64) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	low := binary.BigEndian.Uint64(b[8:]) + n
+	binary.BigEndian.PutUint64(b[8:], low)
+	addr := netip.AddrFrom16(b)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
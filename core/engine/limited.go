@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+const (
+	RelayCheckInterval = time.Second
+	// RelayRefreshRatio is the used part of a relay limit at which the session looks for a direct connection
+	RelayRefreshRatio = 0.8
+	// RelayRenewRatio is the used part of a relay limit at which the session dials a new circuit,
+	// if no direct connection is found
+	RelayRenewRatio = 0.95
+	// allowLimitedReason is attached to the contexts opening VPN streams on limited connections
+	allowLimitedReason = "vpn"
+)
+
+var (
+	ErrRelayRenew = errors.New("relayed connection renewed before the relay limit")
+
+	vpnProtocols = []protocol.ID{VPNBatchStreamProtocol, VPNStreamProtocol}
+)
+
+// RelayUsage is the part of the relay limits used by the relayed connection of a session,
+// a zero limit means no limit
+type RelayUsage struct {
+	LimitDuration time.Duration
+	LimitData     uint64
+	Elapsed       time.Duration
+	Sent          uint64
+	Received      uint64
+}
+
+// connUsage counts the traffic of sessions on a limited connection, the relay limits apply
+// to the whole circuit, however many streams are opened on it
+type connUsage struct {
+	sent, received atomic.Uint64
+}
+
+// enableRelayUsage forget the usage of limited connections when they are closed
+func (e *Engine) enableRelayUsage() {
+	e.host.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(_ network.Network, conn network.Conn) { e.relayUsage.Delete(conn) },
+	})
+}
+
+// connUsage return the usage of a limited connection, it's nil for an unlimited one
+func (e *Engine) connUsage(conn network.Conn) *connUsage {
+	if !conn.Stat().Limited {
+		return nil
+	}
+	actual, _ := e.relayUsage.LoadOrStore(conn, &connUsage{})
+	return actual.(*connUsage)
+}
+
+// relayLimit return the limits of a relayed connection
+func relayLimit(conn network.Conn) (time.Duration, uint64) {
+	stat := conn.Stat()
+	duration, _ := stat.Extra[client.StatLimitDuration].(time.Duration)
+	data, _ := stat.Extra[client.StatLimitData].(uint64)
+	return duration, data
+}
+
+// RelayUsage return the usage of the relay limits, it's nil if the session isn't on a limited connection
+func (s *PeerSession) RelayUsage() *RelayUsage {
+	s.mu.Lock()
+	stream, usage := s.stream, s.usage
+	s.mu.Unlock()
+	if stream == nil || usage == nil {
+		return nil
+	}
+
+	duration, data := relayLimit(stream.Conn())
+	return &RelayUsage{
+		LimitDuration: duration,
+		LimitData:     data,
+		Elapsed:       time.Since(stream.Conn().Stat().Opened),
+		Sent:          usage.sent.Load(),
+		Received:      usage.received.Load(),
+	}
+}
+
+// nearRelayLimit report whether ratio of a relay limit is used
+func (u *RelayUsage) nearRelayLimit(ratio float64) bool {
+	if u.LimitDuration > 0 && u.Elapsed >= time.Duration(float64(u.LimitDuration)*ratio) {
+		return true
+	}
+	return u.LimitData > 0 && float64(max(u.Sent, u.Received)) >= float64(u.LimitData)*ratio
+}
+
+// refreshRelay move the session to a direct connection before the relay resets the current one,
+// like upgrade only the peer which opened the stream moves it. The swarm never dials another
+// relayed connection while one is open, so a new circuit is only dialed by serve after closing the old one.
+func (s *PeerSession) refreshRelay(old network.Stream) {
+	if old.Stat().Direction != network.DirOutbound || !s.migrating.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.migrating.Store(false)
+
+	ctx, cancel := context.WithTimeout(s.ctx, SessionMigrateTimeout)
+	defer cancel()
+
+	conn, err := s.e.host.Network().DialPeer(network.WithForceDirectDial(ctx, forceDirectReason), old.Conn().RemotePeer())
+	if err != nil {
+		s.e.log.Debugf("session [%s] fail to dial a direct connection: %v", s.id, err)
+		return
+	}
+	next, err := newVPNStream(ctx, conn)
+	if err != nil {
+		s.e.log.Debugf("session [%s] fail to open stream on %s: %v", s.id, conn.RemoteMultiaddr(), err)
+		return
+	}
+
+	select {
+	case s.migrate <- next:
+	case <-s.ctx.Done():
+		next.Reset()
+	}
+}
+
+// newVPNStream open a VPN stream on the given connection, which may be limited
+func newVPNStream(ctx context.Context, conn network.Conn) (network.Stream, error) {
+	return newStreamOn(ctx, conn, vpnProtocols...)
+}
+
+// newStreamOn open a stream of one of protocols on the given connection rather than the best one of the peer
+func newStreamOn(ctx context.Context, conn network.Conn, protocols ...protocol.ID) (network.Stream, error) {
+	stream, err := conn.NewStream(network.WithAllowLimitedConn(ctx, allowLimitedReason))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+		defer stream.SetDeadline(time.Time{})
+	}
+
+	selected, err := msmux.SelectOneOf(protocols, stream)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	if err := stream.SetProtocol(selected); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,354 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/miekg/dns"
+	"github.com/wlynxg/NetHive/pkgs/command"
+)
+
+const (
+	MagicDNSSuffix         = "hive"
+	MagicDNSPort           = 53
+	MagicDNSTTL            = 60
+	MagicDNSForwardTimeout = 5 * time.Second
+
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+type magicDNSState struct {
+	mu        sync.Mutex
+	dev       string
+	addr      netip.Addr
+	servers   []*dns.Server
+	upstreams []string
+	// original content of resolv.conf, it's restored on exit
+	resolvConf []byte
+}
+
+// dnsZone return the overlay domain, <NetworkName>.hive. or hive. without a network name
+func (e *Engine) dnsZone() string {
+	if label := dnsLabel(e.cfg.NetworkName); label != "" {
+		return label + "." + MagicDNSSuffix + "."
+	}
+	return MagicDNSSuffix + "."
+}
+
+// enableMagicDNS serve the names of peers on the overlay address
+func (e *Engine) enableMagicDNS(dev string) error {
+	if !e.cfg.EnableMagicDNS {
+		return nil
+	}
+
+	e.magicDNS.mu.Lock()
+	defer e.magicDNS.mu.Unlock()
+
+	e.magicDNS.dev = dev
+	e.magicDNS.upstreams = e.dnsUpstreams()
+	if err := e.startMagicDNSLocked(e.cfg.LocalAddr.Addr()); err != nil {
+		return err
+	}
+	e.addCleanup(e.stopMagicDNS)
+
+	if e.cfg.DNSConfigureSystem {
+		if err := e.configureResolverLocked(); err != nil {
+			return err
+		}
+		e.addCleanup(e.restoreResolver)
+	}
+	e.log.Infof("MagicDNS serves %s on %s, upstreams: %s", e.dnsZone(), e.magicDNS.addr, e.magicDNS.upstreams)
+	return nil
+}
+
+// rebindMagicDNS move MagicDNS to the new overlay address
+func (e *Engine) rebindMagicDNS(addr netip.Addr) {
+	e.magicDNS.mu.Lock()
+	defer e.magicDNS.mu.Unlock()
+
+	if e.magicDNS.servers == nil || e.magicDNS.addr == addr {
+		return
+	}
+	e.stopMagicDNSLocked()
+	if err := e.startMagicDNSLocked(addr); err != nil {
+		e.log.Errorf("fail to start MagicDNS on %s: %v", addr, err)
+		return
+	}
+	if e.cfg.DNSConfigureSystem {
+		if err := e.configureResolverLocked(); err != nil {
+			e.log.Errorf("fail to configure system resolver: %v", err)
+		}
+	}
+}
+
+func (e *Engine) startMagicDNSLocked(addr netip.Addr) error {
+	listen := netip.AddrPortFrom(addr, MagicDNSPort).String()
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	handler := dns.HandlerFunc(e.serveDNS)
+	e.magicDNS.addr = addr
+	e.magicDNS.servers = []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: l, Handler: handler},
+	}
+	for _, server := range e.magicDNS.servers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				e.log.Debugf("MagicDNS server stopped: %v", err)
+			}
+		}(server)
+	}
+	return nil
+}
+
+func (e *Engine) stopMagicDNS() {
+	e.magicDNS.mu.Lock()
+	defer e.magicDNS.mu.Unlock()
+	e.stopMagicDNSLocked()
+}
+
+func (e *Engine) stopMagicDNSLocked() {
+	for _, server := range e.magicDNS.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), MagicDNSForwardTimeout)
+		server.ShutdownContext(ctx)
+		cancel()
+		// a server which hasn't started yet can't be shut down
+		if server.PacketConn != nil {
+			server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			server.Listener.Close()
+		}
+	}
+	e.magicDNS.servers = nil
+}
+
+// dnsUpstreams return DNSUpstreams or the nameservers of resolv.conf other than MagicDNS itself
+func (e *Engine) dnsUpstreams() []string {
+	servers := e.cfg.DNSUpstreams
+	if len(servers) == 0 {
+		if conf, err := dns.ClientConfigFromFile(resolvConfPath); err == nil {
+			servers = conf.Servers
+		}
+	}
+
+	var upstreams []string
+	for _, server := range servers {
+		if addr, err := netip.ParseAddr(server); err == nil {
+			if addr == e.cfg.LocalAddr.Addr() {
+				continue
+			}
+			server = netip.AddrPortFrom(addr, MagicDNSPort).String()
+		}
+		upstreams = append(upstreams, server)
+	}
+	return upstreams
+}
+
+// serveDNS answer A and AAAA queries of the overlay domain and forward the others
+func (e *Engine) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	zone := e.dnsZone()
+	if len(r.Question) != 1 || !dns.IsSubDomain(zone, strings.ToLower(r.Question[0].Name)) {
+		e.forwardDNS(w, r)
+		return
+	}
+
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	label := strings.TrimSuffix(strings.ToLower(q.Name), "."+zone)
+	if strings.ToLower(q.Name) == zone {
+		m.Ns = append(m.Ns, e.dnsSOA(zone))
+		w.WriteMsg(m)
+		return
+	}
+
+	v4, v6, ok := e.resolveName(label)
+	if !ok {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, e.dnsSOA(zone))
+		w.WriteMsg(m)
+		return
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: MagicDNSTTL}
+	switch {
+	case q.Qtype == dns.TypeA && v4.IsValid():
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: v4.AsSlice()})
+	case q.Qtype == dns.TypeAAAA && v6.IsValid():
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: v6.AsSlice()})
+	default:
+		m.Ns = append(m.Ns, e.dnsSOA(zone))
+	}
+	w.WriteMsg(m)
+}
+
+func (e *Engine) dnsSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: MagicDNSTTL},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  MagicDNSTTL,
+	}
+}
+
+// forwardDNS send the query to upstreams one by one until one of them answers
+func (e *Engine) forwardDNS(w dns.ResponseWriter, r *dns.Msg) {
+	e.magicDNS.mu.Lock()
+	upstreams := e.magicDNS.upstreams
+	e.magicDNS.mu.Unlock()
+
+	c := &dns.Client{Net: w.LocalAddr().Network(), Timeout: MagicDNSForwardTimeout}
+	for _, upstream := range upstreams {
+		resp, _, err := c.Exchange(r, upstream)
+		if err == nil {
+			w.WriteMsg(resp)
+			return
+		}
+		e.log.Debugf("fail to forward DNS query to %s: %v", upstream, err)
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+// resolveName return the overlay addresses of the node whose name is label, the local
+// node included. When several peers announce the same name, the smallest peer ID wins.
+func (e *Engine) resolveName(label string) (v4, v6 netip.Addr, ok bool) {
+	if label == "" || strings.Contains(label, ".") {
+		return v4, v6, false
+	}
+	if dnsLabel(e.cfg.NodeName) == label {
+		return e.cfg.LocalAddr.Addr(), e.addr6, true
+	}
+
+	var (
+		id     string
+		prefix []netip.Prefix
+	)
+	e.announce.mu.Lock()
+	for pid, a := range e.announce.peers {
+		if dnsLabel(a.Name) == label && (id == "" || pid < id) {
+			id, prefix = pid, a.Prefixes
+		}
+	}
+	e.announce.mu.Unlock()
+	if id == "" {
+		return v4, v6, false
+	}
+
+	v4 = e.peerAddr(id, prefix)
+	if pid, err := peer.Decode(id); err == nil && e.addr6.IsValid() {
+		v6 = PeerAddr6(pid)
+	}
+	return v4, v6, true
+}
+
+// peerAddr return the overlay address of peer id, which is its address claim,
+// its single address in PeersRouteTable or an announced address of the overlay
+func (e *Engine) peerAddr(id string, announced []netip.Prefix) netip.Addr {
+	e.ipam.mu.Lock()
+	claim, ok := e.ipam.claims[id]
+	e.ipam.mu.Unlock()
+	if ok {
+		return claim.Addr
+	}
+
+	if prefix, ok := e.routeTable.m.Load(id); ok && prefix.IsValid() && prefix.IsSingleIP() {
+		return prefix.Addr()
+	}
+	overlay := e.cfg.LocalAddr.Masked()
+	for _, prefix := range announced {
+		if prefix.IsSingleIP() && overlay.Contains(prefix.Addr()) {
+			return prefix.Addr()
+		}
+	}
+	return netip.Addr{}
+}
+
+// configureResolverLocked send the queries of the overlay domain to MagicDNS, through
+// systemd-resolved if it's running, otherwise MagicDNS becomes the first nameserver of resolv.conf
+func (e *Engine) configureResolverLocked() error {
+	zone := strings.TrimSuffix(e.dnsZone(), ".")
+	if command.HasResolved() {
+		return command.ResolvectlLink(e.magicDNS.dev, e.magicDNS.addr, zone)
+	}
+
+	if e.magicDNS.resolvConf == nil {
+		orig, err := os.ReadFile(resolvConfPath)
+		if err != nil {
+			return err
+		}
+		e.magicDNS.resolvConf = orig
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# generated by NetHive, the original file is restored on exit\n")
+	fmt.Fprintf(&buf, "nameserver %s\n", e.magicDNS.addr)
+	fmt.Fprintf(&buf, "search %s\n", zone)
+	for _, line := range strings.Split(string(e.magicDNS.resolvConf), "\n") {
+		// MagicDNS forwards queries to the original nameservers
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "nameserver" || fields[0] == "search" || fields[0] == "domain") {
+			continue
+		}
+		if line != "" {
+			fmt.Fprintln(&buf, line)
+		}
+	}
+	return os.WriteFile(resolvConfPath, buf.Bytes(), 0644)
+}
+
+func (e *Engine) restoreResolver() {
+	e.magicDNS.mu.Lock()
+	defer e.magicDNS.mu.Unlock()
+
+	if e.magicDNS.resolvConf == nil {
+		if err := command.ResolvectlRevert(e.magicDNS.dev); err != nil {
+			e.log.Warnf("fail to revert resolver of %s: %v", e.magicDNS.dev, err)
+		}
+		return
+	}
+	if err := os.WriteFile(resolvConfPath, e.magicDNS.resolvConf, 0644); err != nil {
+		e.log.Warnf("fail to restore %s: %v", resolvConfPath, err)
+	}
+}
+
+// dnsLabel turn a name into a DNS label, letters are lowered and other
+// characters than letters, digits and hyphens are replaced by hyphens
+func dnsLabel(name string) string {
+	label := []byte(strings.ToLower(name))
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			label[i] = '-'
+		}
+	}
+	s := strings.Trim(string(label), "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
@@ -0,0 +1,364 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	HeartbeatInterval = 30 * time.Second
+	// OnlineTimeout is the time a member is online after its last heartbeat
+	OnlineTimeout = 3 * HeartbeatInterval
+	// GossipDegree is the number of network peers kept connected for gossip
+	GossipDegree = 6
+
+	membersSignDomain   = "NetHive/members:"
+	heartbeatSignDomain = "NetHive/heartbeat:"
+)
+
+// MemberList is the members of a network signed by the network admin,
+// a list with a greater version replaces the current one
+type MemberList struct {
+	Network   string
+	Version   int64
+	Members   []string
+	Signature []byte
+}
+
+func (l *MemberList) signedData() []byte {
+	return []byte(fmt.Sprintf("%s|%d|%s", l.Network, l.Version, strings.Join(l.Members, ",")))
+}
+
+// Heartbeat is published by every member periodically, Leave is set when the member goes offline
+type Heartbeat struct {
+	Network   string
+	PeerID    string
+	Seq       int64
+	Leave     bool
+	Signature []byte
+}
+
+func (h *Heartbeat) signedData() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%d|%t", h.Network, h.PeerID, h.Seq, h.Leave))
+}
+
+// membershipMessage is published on the topic of a network
+type membershipMessage struct {
+	MemberList *MemberList `json:",omitempty"`
+	Heartbeat  *Heartbeat  `json:",omitempty"`
+}
+
+type membershipState struct {
+	mu   sync.Mutex
+	list *MemberList
+	// seq and time of the last heartbeat of every member
+	seq      map[string]int64
+	lastSeen map[string]time.Time
+}
+
+func (e *Engine) networkTopic() string {
+	return "/NetHive/network/" + e.cfg.NetworkName + "/members"
+}
+
+func (e *Engine) isNetworkAdmin() bool {
+	return e.cfg.NetworkAdmin == e.host.ID().String()
+}
+
+// enableMembership join the network, members of the list signed by NetworkAdmin are trusted like
+// peers of PeersRouteTable. The admin node signs NetworkMembers, other nodes learn the list by gossip.
+func (e *Engine) enableMembership() error {
+	if e.cfg.NetworkName == "" {
+		return nil
+	}
+	if _, err := peer.Decode(e.cfg.NetworkAdmin); err != nil {
+		return errors.Wrap(err, "invalid NetworkAdmin")
+	}
+
+	e.subscribe(e.networkTopic(), e.handleMembership)
+	e.host.SetStreamHandler(GossipProtocol, e.GossipHandler)
+
+	if e.isNetworkAdmin() {
+		if err := e.signMemberList(); err != nil {
+			return err
+		}
+	}
+
+	// a peer connecting later gets the member list at once instead of waiting for the next publish
+	e.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) { go e.sendMembership(conn.RemotePeer()) },
+	})
+
+	e.addCleanup(e.leaveNetwork)
+	go e.membershipLoop()
+	e.log.Infof("join network %s", e.cfg.NetworkName)
+	return nil
+}
+
+// signMemberList sign NetworkMembers as a new version of member list, only the admin can do it
+func (e *Engine) signMemberList() error {
+	members := append([]string{e.host.ID().String()}, e.cfg.NetworkMembers...)
+	slices.Sort(members)
+	members = slices.Compact(members)
+
+	list := &MemberList{Network: e.cfg.NetworkName, Version: time.Now().UnixNano(), Members: members}
+	sig, err := e.signRecord(membersSignDomain, list.signedData())
+	if err != nil {
+		return err
+	}
+	list.Signature = sig
+	e.applyMemberList(list)
+	return nil
+}
+
+// sendMembership send the member list and a heartbeat of this node to a new connected peer
+func (e *Engine) sendMembership(id peer.ID) {
+	e.membership.mu.Lock()
+	list := e.membership.list
+	e.membership.mu.Unlock()
+
+	var msgs []*membershipMessage
+	if list != nil {
+		msgs = append(msgs, &membershipMessage{MemberList: list})
+	}
+	if h, err := e.heartbeat(false); err == nil {
+		msgs = append(msgs, &membershipMessage{Heartbeat: h})
+	}
+
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		if err := e.sendGossip(e.ctx, id, &gossipMessage{Topic: e.networkTopic(), Data: data}); err != nil {
+			e.log.Debugf("fail to send membership to %s: %v", id, err)
+			return
+		}
+	}
+}
+
+// handleMembership verify and apply a message of the network topic
+func (e *Engine) handleMembership(_ peer.ID, data []byte) bool {
+	var msg membershipMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return false
+	}
+
+	switch {
+	case msg.MemberList != nil:
+		list := msg.MemberList
+		if list.Network != e.cfg.NetworkName {
+			return false
+		}
+		e.membership.mu.Lock()
+		cur := e.membership.list
+		e.membership.mu.Unlock()
+		if cur != nil && cur.Version >= list.Version {
+			return false
+		}
+
+		admin, _ := peer.Decode(e.cfg.NetworkAdmin)
+		if err := e.verifyRecord(admin, membersSignDomain, list.signedData(), list.Signature); err != nil {
+			e.log.Warnf("drop member list of network %s: %v", list.Network, err)
+			return false
+		}
+		e.applyMemberList(list)
+		return true
+	case msg.Heartbeat != nil:
+		return e.handleHeartbeat(msg.Heartbeat)
+	}
+	return false
+}
+
+func (e *Engine) handleHeartbeat(h *Heartbeat) bool {
+	if h.Network != e.cfg.NetworkName || !e.IsNetworkMember(h.PeerID) {
+		return false
+	}
+
+	e.membership.mu.Lock()
+	seq := e.membership.seq[h.PeerID]
+	e.membership.mu.Unlock()
+	if h.Seq <= seq {
+		return false
+	}
+
+	id, err := peer.Decode(h.PeerID)
+	if err != nil {
+		return false
+	}
+	if err := e.verifyRecord(id, heartbeatSignDomain, h.signedData(), h.Signature); err != nil {
+		e.log.Warnf("drop heartbeat of %s: %v", h.PeerID, err)
+		return false
+	}
+
+	e.membership.mu.Lock()
+	defer e.membership.mu.Unlock()
+	if h.Seq <= e.membership.seq[h.PeerID] {
+		return false
+	}
+	e.membership.seq[h.PeerID] = h.Seq
+	if h.Leave {
+		delete(e.membership.lastSeen, h.PeerID)
+		e.log.Infof("member %s left network %s", h.PeerID, h.Network)
+	} else {
+		if _, ok := e.membership.lastSeen[h.PeerID]; !ok {
+			e.log.Infof("member %s is online", h.PeerID)
+			go func() {
+				if err := e.exchangeAnnouncements(h.PeerID); err != nil {
+					e.log.Debugf("fail to exchange route announcements with %s: %v", h.PeerID, err)
+				}
+			}()
+		}
+		e.membership.lastSeen[h.PeerID] = time.Now()
+	}
+	return true
+}
+
+// applyMemberList make the members of list members of the engine and remove the peers
+// which are no longer listed, unless they are configured statically
+func (e *Engine) applyMemberList(list *MemberList) {
+	e.membership.mu.Lock()
+	var old []string
+	if e.membership.list != nil {
+		old = e.membership.list.Members
+	}
+	e.membership.list = list
+	e.membership.mu.Unlock()
+
+	self := e.host.ID().String()
+	for _, id := range list.Members {
+		if id != self && !slices.Contains(old, id) {
+			e.routeTable.m.LoadOrStore(id, netip.Prefix{})
+			e.log.Infof("member %s joined network %s", id, list.Network)
+		}
+	}
+
+	e.ipam.mu.Lock()
+	configured := configuredPrefixes(e.cfg)
+	e.ipam.mu.Unlock()
+	for _, id := range old {
+		if _, ok := configured[id]; ok || id == self || id == e.cfg.ExitNode || slices.Contains(list.Members, id) {
+			continue
+		}
+		e.removePeer(id)
+		e.membership.mu.Lock()
+		delete(e.membership.lastSeen, id)
+		e.membership.mu.Unlock()
+	}
+	e.log.Debugf("member list of network %s version %d: %v", list.Network, list.Version, list.Members)
+}
+
+// IsNetworkMember report whether id is in the member list of the network
+func (e *Engine) IsNetworkMember(id string) bool {
+	e.membership.mu.Lock()
+	defer e.membership.mu.Unlock()
+	return e.membership.list != nil && slices.Contains(e.membership.list.Members, id)
+}
+
+// IsOnline report whether a heartbeat of member id is received recently
+func (e *Engine) IsOnline(id string) bool {
+	e.membership.mu.Lock()
+	defer e.membership.mu.Unlock()
+	t, ok := e.membership.lastSeen[id]
+	return ok && time.Since(t) < OnlineTimeout
+}
+
+// MemberListVersion return the version of the current member list, it's zero without list
+func (e *Engine) MemberListVersion() int64 {
+	e.membership.mu.Lock()
+	defer e.membership.mu.Unlock()
+	if e.membership.list == nil {
+		return 0
+	}
+	return e.membership.list.Version
+}
+
+func (e *Engine) heartbeat(leave bool) (*Heartbeat, error) {
+	h := &Heartbeat{Network: e.cfg.NetworkName, PeerID: e.host.ID().String(), Seq: time.Now().UnixNano(), Leave: leave}
+	sig, err := e.signRecord(heartbeatSignDomain, h.signedData())
+	if err != nil {
+		return nil, err
+	}
+	h.Signature = sig
+	return h, nil
+}
+
+// membershipLoop publish heartbeats and the member list, so that peers joining later learn
+// the list soon, and keep GossipDegree peers of the network connected
+func (e *Engine) membershipLoop() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	advertised := false
+	for {
+		if !advertised && e.dht != nil && e.dht.RoutingTable().Size() > 0 {
+			util.Advertise(e.ctx, e.discovery, e.networkTopic())
+			advertised = true
+		}
+		e.connectNetworkPeers()
+		e.expireSeen()
+
+		e.membership.mu.Lock()
+		list := e.membership.list
+		e.membership.mu.Unlock()
+		if list != nil {
+			e.publish(e.ctx, e.networkTopic(), &membershipMessage{MemberList: list})
+		}
+		if h, err := e.heartbeat(false); err == nil {
+			e.publish(e.ctx, e.networkTopic(), &membershipMessage{Heartbeat: h})
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connectNetworkPeers connect the admin and peers advertising the network until GossipDegree peers are connected
+func (e *Engine) connectNetworkPeers() {
+	ctx, cancel := context.WithTimeout(e.ctx, GossipTimeout)
+	defer cancel()
+
+	if admin, err := peer.Decode(e.cfg.NetworkAdmin); err == nil && admin != e.host.ID() {
+		e.connect(ctx, admin)
+	}
+	if len(e.gossipPeers()) >= GossipDegree || e.dht == nil {
+		return
+	}
+
+	infos, err := e.discovery.FindPeers(ctx, e.networkTopic())
+	if err != nil {
+		return
+	}
+	for info := range infos {
+		if info.ID == e.host.ID() || len(info.Addrs) == 0 {
+			continue
+		}
+		if e.host.Connect(ctx, info) == nil && len(e.gossipPeers()) >= GossipDegree {
+			return
+		}
+	}
+}
+
+// leaveNetwork tell the network this node goes offline
+func (e *Engine) leaveNetwork() {
+	h, err := e.heartbeat(true)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GossipTimeout)
+	defer cancel()
+	e.publish(ctx, e.networkTopic(), &membershipMessage{Heartbeat: h})
+}
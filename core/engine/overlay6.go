@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"net/netip"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// OverlayPrefix6Bits is the length of the prefix which PeerID derived addresses live in
+	OverlayPrefix6Bits = 48
+	// overlayMissTTL limits how often an unknown overlay address triggers a peerstore scan
+	overlayMissTTL = 10 * time.Second
+)
+
+var (
+	// OverlayPrefix6 is the IPv6 ULA prefix of PeerID derived addresses, "NetHi" in hex
+	OverlayPrefix6 = netip.MustParsePrefix("fd4e:6574:4869::/48")
+)
+
+// PeerAddr6 return the IPv6 overlay address of peer id, the host bits are
+// the leading bytes of sha256(id), so every node derives the same address
+func PeerAddr6(id peer.ID) netip.Addr {
+	hash := sha256.Sum256([]byte(id))
+	b := OverlayPrefix6.Addr().As16()
+	copy(b[OverlayPrefix6Bits/8:], hash[:])
+	return netip.AddrFrom16(b)
+}
+
+// enableOverlay6 assign the PeerID derived address to the device and
+// learn the addresses of peers as soon as they connect
+func (e *Engine) enableOverlay6() error {
+	if !e.cfg.EnableOverlayIPv6 {
+		return nil
+	}
+
+	e.addr6 = PeerAddr6(e.host.ID())
+	addr := netip.PrefixFrom(e.addr6, OverlayPrefix6Bits)
+	if err := e.device.AddAddress(addr); err != nil {
+		return err
+	}
+
+	e.routeTable.m.Range(func(key string, _ netip.Prefix) bool {
+		if id, err := peer.Decode(key); err == nil {
+			e.learnAddr6(id)
+		}
+		return true
+	})
+	e.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) { e.learnAddr6(conn.RemotePeer()) },
+	})
+
+	e.log.Infof("overlay IPv6 address: %s", addr)
+	return nil
+}
+
+func (e *Engine) learnAddr6(id peer.ID) {
+	e.routeTable.addr6.Store(PeerAddr6(id), id.String())
+}
+
+// resolveAddr6 return the peer which owns the PeerID derived address, peers
+// never seen by this node can't be resolved since the hash is one-way
+func (e *Engine) resolveAddr6(addr netip.Addr) (string, bool) {
+	if id, ok := e.routeTable.addr6.Load(addr); ok {
+		return id, true
+	}
+	if missed, ok := e.routeTable.miss6.Load(addr); ok && time.Since(missed) < overlayMissTTL {
+		return "", false
+	}
+
+	for _, id := range e.host.Peerstore().Peers() {
+		e.learnAddr6(id)
+	}
+	if id, ok := e.routeTable.addr6.Load(addr); ok {
+		e.routeTable.miss6.Delete(addr)
+		return id, true
+	}
+	e.routeTable.miss6.Store(addr, time.Now())
+	return "", false
+}
+
+// isOverlay6 report whether addr is a PeerID derived address
+func (e *Engine) isOverlay6(addr netip.Addr) bool {
+	return e.cfg.EnableOverlayIPv6 && OverlayPrefix6.Contains(addr)
+}
@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	PathProbeInterval = 30 * time.Second
+	PathProbeCount    = 5
+	PathProbeTimeout  = 2 * time.Second
+	// PathSwitchRatio is the RTT ratio another path must reach to replace the current one, it prevents flapping
+	PathSwitchRatio = 0.7
+	// PathLossMargin is the loss difference which makes a path better regardless of RTT
+	PathLossMargin = 0.2
+
+	forceDirectReason = "path probe"
+)
+
+// PathQuality is the measured quality of a connection to a peer, RTT is the average of the answered probes
+type PathQuality struct {
+	Addr     string
+	Relayed  bool
+	RTT      time.Duration
+	Loss     float64
+	Selected bool
+}
+
+type pathProbe struct {
+	conn network.Conn
+	PathQuality
+}
+
+// less report whether p ranks before o: a path with answered probes, a direct path,
+// a path with clearly less loss and then a path with lower RTT
+func (p *PathQuality) less(o *PathQuality) bool {
+	switch {
+	case (p.Loss < 1) != (o.Loss < 1):
+		return p.Loss < 1
+	case p.Relayed != o.Relayed:
+		return !p.Relayed
+	case p.Loss+PathLossMargin <= o.Loss:
+		return true
+	case o.Loss+PathLossMargin <= p.Loss:
+		return false
+	}
+	return p.RTT < o.RTT
+}
+
+// preferred report whether the session should move from the path cur to p
+func (p *PathQuality) preferred(cur *PathQuality) bool {
+	if !p.less(cur) {
+		return false
+	}
+	if p.Relayed != cur.Relayed || cur.Loss >= 1 || p.Loss+PathLossMargin <= cur.Loss {
+		return true
+	}
+	return float64(p.RTT) < float64(cur.RTT)*PathSwitchRatio
+}
+
+// pathLoop re-evaluate the paths of working sessions periodically
+func (e *Engine) pathLoop() {
+	ticker := time.NewTicker(PathProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		e.routeTable.id.Range(func(_ string, s *PeerSession) bool {
+			if s.State().Working() {
+				go s.probePaths()
+			}
+			return true
+		})
+	}
+}
+
+// Paths return the quality of the connections measured by the last probe
+func (s *PeerSession) Paths() []PathQuality {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := make([]PathQuality, len(s.paths))
+	for i, p := range s.paths {
+		paths[i] = p.PathQuality
+		paths[i].Selected = s.stream != nil && p.conn == s.stream.Conn()
+	}
+	return paths
+}
+
+// RTT return the RTT of the connection in use, it's zero if it hasn't been measured
+func (s *PeerSession) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.paths {
+		if s.stream != nil && p.conn == s.stream.Conn() {
+			return p.RTT
+		}
+	}
+	return 0
+}
+
+// probePaths measure every connection to the peer and move the session to the best one.
+// Like upgrade only the peer which opened the stream moves it.
+func (s *PeerSession) probePaths() {
+	if !s.probing.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.probing.Store(false)
+
+	pid, err := peer.Decode(s.id)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, SessionMigrateTimeout)
+	defer cancel()
+
+	// with only relayed connections, try a direct one, the swarm dials LAN addresses first
+	if !s.e.hasDirectConn(pid) {
+		if _, err := s.e.host.Network().DialPeer(network.WithForceDirectDial(ctx, forceDirectReason), pid); err != nil {
+			s.e.log.Debugf("session [%s] fail to dial a direct connection: %v", s.id, err)
+		}
+	}
+
+	conns := s.e.host.Network().ConnsToPeer(pid)
+	probes := make([]pathProbe, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn network.Conn) {
+			defer wg.Done()
+			probes[i] = probePath(ctx, conn)
+		}(i, conn)
+	}
+	wg.Wait()
+	sort.SliceStable(probes, func(i, j int) bool { return probes[i].less(&probes[j].PathQuality) })
+
+	s.mu.Lock()
+	s.paths = probes
+	stream := s.stream
+	s.mu.Unlock()
+	if stream == nil || len(probes) == 0 || stream.Stat().Direction != network.DirOutbound {
+		return
+	}
+
+	best := &probes[0]
+	if best.conn == stream.Conn() {
+		return
+	}
+	for i := range probes {
+		if probes[i].conn == stream.Conn() && !best.preferred(&probes[i].PathQuality) {
+			return
+		}
+	}
+	s.e.log.Debugf("session [%s] best path %s, rtt %s, loss %.0f%%", s.id, best.Addr, best.RTT, best.Loss*100)
+	s.switchConn(ctx, best.conn)
+}
+
+// switchConn open a new stream on conn and hand it over to the session
+func (s *PeerSession) switchConn(ctx context.Context, conn network.Conn) {
+	if !s.migrating.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.migrating.Store(false)
+
+	next, err := newVPNStream(ctx, conn)
+	if err != nil {
+		s.e.log.Debugf("session [%s] fail to open stream on %s: %v", s.id, conn.RemoteMultiaddr(), err)
+		return
+	}
+
+	select {
+	case s.migrate <- next:
+	case <-s.ctx.Done():
+		next.Reset()
+	}
+}
+
+func (e *Engine) hasDirectConn(id peer.ID) bool {
+	for _, conn := range e.host.Network().ConnsToPeer(id) {
+		if !isRelayed(conn) {
+			return true
+		}
+	}
+	return false
+}
+
+// probePath send PathProbeCount libp2p pings on conn
+func probePath(ctx context.Context, conn network.Conn) pathProbe {
+	p := pathProbe{conn: conn}
+	p.Addr = conn.RemoteMultiaddr().String()
+	p.Relayed = isRelayed(conn)
+	p.Loss = 1
+
+	stream, err := newStreamOn(ctx, conn, ping.ID)
+	if err != nil {
+		return p
+	}
+	defer stream.Reset()
+
+	var (
+		total    time.Duration
+		answered int
+		buf      = make([]byte, ping.PingSize)
+		echo     = make([]byte, ping.PingSize)
+	)
+	for i := 0; i < PathProbeCount; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			break
+		}
+		stream.SetDeadline(time.Now().Add(PathProbeTimeout))
+		start := time.Now()
+		if _, err := stream.Write(buf); err != nil {
+			break
+		}
+		// a lost probe breaks the stream, the following ones are lost too
+		if _, err := io.ReadFull(stream, echo); err != nil || !bytes.Equal(buf, echo) {
+			break
+		}
+		total += time.Since(start)
+		answered++
+	}
+
+	if answered > 0 {
+		p.RTT = total / time.Duration(answered)
+	}
+	p.Loss = float64(PathProbeCount-answered) / PathProbeCount
+	return p
+}
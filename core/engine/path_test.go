@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathPreferred(t *testing.T) {
+	lan := PathQuality{Addr: "lan", RTT: time.Millisecond}
+	wan := PathQuality{Addr: "wan", RTT: 30 * time.Millisecond}
+	wanFast := PathQuality{Addr: "wan-fast", RTT: 25 * time.Millisecond}
+	lossy := PathQuality{Addr: "lossy", RTT: 500 * time.Microsecond, Loss: 0.6}
+	relay := PathQuality{Addr: "relay", Relayed: true, RTT: 10 * time.Millisecond}
+	dead := PathQuality{Addr: "dead", Loss: 1}
+
+	tests := []struct {
+		p, cur PathQuality
+		want   bool
+	}{
+		{lan, relay, true},
+		{relay, lan, false},
+		{wan, relay, true},
+		{lan, wan, true},
+		{wan, lan, false},
+		// not fast enough to leave the current path
+		{wanFast, wan, false},
+		{lan, lossy, true},
+		{lossy, lan, false},
+		{relay, dead, true},
+		{dead, relay, false},
+	}
+	for _, tt := range tests {
+		if got := tt.p.preferred(&tt.cur); got != tt.want {
+			t.Errorf("%s.preferred(%s) = %t, want %t", tt.p.Addr, tt.cur.Addr, got, tt.want)
+		}
+	}
+}
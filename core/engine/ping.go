@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+type PingResult struct {
+	PeerID string
+	// Addr is the remote address of the connection used by ping
+	Addr  string
+	RTT   time.Duration
+	Error string
+}
+
+// ResolvePeer return the peer of target, which is a peer ID or an overlay address
+func (e *Engine) ResolvePeer(target string) (peer.ID, error) {
+	if id, err := peer.Decode(target); err == nil {
+		return id, nil
+	}
+
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither a peer ID nor an IP address", target)
+	}
+	_, id, ok := e.routeTable.prefix.Lookup(addr)
+	if !ok && e.isOverlay6(addr) {
+		id, ok = e.resolveAddr6(addr)
+	}
+	if !ok {
+		return "", fmt.Errorf("no peer routes %s", addr)
+	}
+	return peer.Decode(id)
+}
+
+// Ping send count libp2p pings to the peer of target
+func (e *Engine) Ping(ctx context.Context, target string, count int) ([]PingResult, error) {
+	id, err := e.ResolvePeer(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.connect(ctx, id); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var results []PingResult
+	for r := range ping.Ping(ctx, e.host, id) {
+		result := PingResult{PeerID: id.String(), RTT: r.RTT}
+		if r.Error != nil {
+			result.Error = r.Error.Error()
+		}
+		if conns := e.host.Network().ConnsToPeer(id); len(conns) > 0 {
+			result.Addr = conns[0].RemoteMultiaddr().String()
+		}
+		results = append(results, result)
+		if len(results) >= count || r.Error != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return results, nil
+		case <-time.After(time.Second):
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// signRecord sign data in domain with the host key, the domain keeps a signature
+// of one kind of record from being accepted as another kind
+func (e *Engine) signRecord(domain string, data []byte) ([]byte, error) {
+	key := e.host.Peerstore().PrivKey(e.host.ID())
+	if key == nil {
+		return nil, errors.New("private key of host not found")
+	}
+	return key.Sign(append([]byte(domain), data...))
+}
+
+// verifyRecord verify that data in domain is signed by peer id
+func (e *Engine) verifyRecord(id peer.ID, domain string, data, sig []byte) error {
+	key := e.host.Peerstore().PubKey(id)
+	if key == nil {
+		return fmt.Errorf("public key of %s not found", id)
+	}
+	ok, err := key.Verify(append([]byte(domain), data...), sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// readRecords read a JSON message of records from stream
+func readRecords(stream network.Stream, v any) error {
+	mr := msgio.NewVarintReaderSize(stream, network.MessageSizeMax)
+	msg, err := mr.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer mr.ReleaseMsg(msg)
+	return json.Unmarshal(msg, v)
+}
+
+// writeRecords write v to stream as a JSON message
+func writeRecords(stream network.Stream, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return msgio.NewVarintWriter(stream).WriteMsg(data)
+}
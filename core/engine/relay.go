@@ -5,8 +5,63 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	mlog "github.com/wlynxg/NetHive/pkgs/log"
 )
 
+func parseRelays(log *mlog.Logger, addrs []string) *[]peer.AddrInfo {
+	relays := make([]peer.AddrInfo, 0, len(addrs))
+	for _, relay := range addrs {
+		addrInfo, err := peer.AddrInfoFromString(relay)
+		if err != nil {
+			log.Warnf("fail to parse '%s': %v", relay, err)
+			continue
+		}
+		relays = append(relays, *addrInfo)
+	}
+	return &relays
+}
+
+// relayPeerSource feed auto relay with the configured relays first,
+// then with the candidates found by autoRelayFinder
+func (e *Engine) relayPeerSource(ctx context.Context, num int) <-chan peer.AddrInfo {
+	c := make(chan peer.AddrInfo, num)
+	go func() {
+		defer close(c)
+		for _, relay := range *e.relays.Load() {
+			if num <= 0 {
+				return
+			}
+			select {
+			case c <- relay:
+				num--
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if e.relayChan == nil {
+			return
+		}
+		for ; num > 0; num-- {
+			select {
+			case v, ok := <-e.relayChan:
+				if !ok {
+					return
+				}
+				e.log.Debugf("auto relay find node: %v", v)
+				select {
+				case c <- v:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c
+}
+
 func (e *Engine) autoRelayFinder(ctx context.Context) {
 	e.log.Debugf("successfully start auto relay finder!")
 	peers := e.host.Network().Peers()
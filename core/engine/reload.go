@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+
+	"github.com/wlynxg/NetHive/core/config"
+	"github.com/wlynxg/NetHive/core/firewall"
+	mlog "github.com/wlynxg/NetHive/pkgs/log"
+)
+
+// reloadableFields are applied by Reload without restarting the engine
+var reloadableFields = map[string]bool{
+	"PeersRouteTable": true,
+	"PeersSubnets":    true,
+	"TrustedPeers":    true,
+	"NetworkMembers":  true,
+	"Relays":          true,
+	"LogConfigs":      true,
+	"ACL":             true,
+}
+
+// Reload apply the peers, subnets, relays, ACL and log levels of cfg to the running engine.
+// Other changed settings are returned, they take effect after a restart.
+func (e *Engine) Reload(cfg *config.Config) ([]string, error) {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	if e.device == nil {
+		return nil, errors.New("engine isn't running")
+	}
+	name, err := e.device.Name()
+	if err != nil {
+		return nil, err
+	}
+	fw, err := firewall.New(cfg.ACL)
+	if err != nil {
+		return nil, err
+	}
+
+	e.ipam.mu.Lock()
+	restart := e.restartFields(cfg)
+	old := configuredPrefixes(e.cfg)
+	e.cfg.PeersRouteTable = cfg.PeersRouteTable
+	e.cfg.PeersSubnets = cfg.PeersSubnets
+	e.cfg.TrustedPeers = cfg.TrustedPeers
+	membersChanged := !reflect.DeepEqual(e.cfg.NetworkMembers, cfg.NetworkMembers)
+	e.cfg.NetworkMembers = cfg.NetworkMembers
+	e.cfg.Relays = cfg.Relays
+	e.cfg.LogConfigs = cfg.LogConfigs
+	e.cfg.ACL = cfg.ACL
+	e.ipam.mu.Unlock()
+	e.firewall.Store(fw)
+
+	e.reloadPeers(name, old, configuredPrefixes(cfg), cfg.PeersRouteTable)
+	e.rerouteAnnouncements()
+
+	if membersChanged && e.cfg.NetworkName != "" && e.isNetworkAdmin() {
+		if err := e.signMemberList(); err != nil {
+			return restart, err
+		}
+		e.membership.mu.Lock()
+		list := e.membership.list
+		e.membership.mu.Unlock()
+		go e.publish(e.ctx, e.networkTopic(), &membershipMessage{MemberList: list})
+	}
+
+	if e.relaySource {
+		e.relays.Store(parseRelays(e.log, cfg.Relays))
+	}
+	mlog.SetLevels(cfg.LogConfigs...)
+
+	for _, field := range restart {
+		e.log.Warnf("%s is changed, restart to apply it", field)
+	}
+	e.log.Infof("config reloaded")
+	return restart, nil
+}
+
+// reloadPeers remove the peers and prefixes missing in the new config and add the new ones
+func (e *Engine) reloadPeers(dev string, old, next map[string]map[netip.Prefix]bool, table map[string]netip.Prefix) {
+	for id, prefixes := range old {
+		if _, ok := next[id]; !ok && id != e.cfg.ExitNode {
+			e.removePeer(id)
+			continue
+		}
+		for prefix := range prefixes {
+			// skip prefixes which have been taken over by another peer
+			if next[id][prefix] || e.routeTable.prefix.Owner(prefix) != id {
+				continue
+			}
+			e.routeTable.prefix.Del(prefix)
+			e.delPeerRoute(prefix)
+			e.log.Infof("remove %s's route: %s", id, prefix)
+		}
+	}
+
+	for id, prefixes := range next {
+		if prefix, ok := table[id]; ok {
+			e.routeTable.m.Store(id, peerPrefix(prefix))
+		} else {
+			e.routeTable.m.LoadOrStore(id, netip.Prefix{})
+		}
+		for prefix := range prefixes {
+			if !old[id][prefix] {
+				e.addPeerPrefix(dev, id, prefix)
+			}
+		}
+	}
+}
+
+// removePeer close the session of the peer and remove all its routes
+func (e *Engine) removePeer(id string) {
+	e.routeTable.m.Delete(id)
+	for _, prefix := range e.routeTable.prefix.DelPeer(id) {
+		e.delPeerRoute(prefix)
+	}
+	if s, ok := e.routeTable.id.Load(id); ok {
+		s.Close()
+	}
+	e.forgetAnnouncement(id)
+	e.conntrack.DelPeer(id)
+	e.log.Infof("remove peer %s", id)
+}
+
+// configuredPrefixes return the prefixes of every peer in PeersRouteTable and PeersSubnets,
+// trusted peers are included without prefixes
+func configuredPrefixes(cfg *config.Config) map[string]map[netip.Prefix]bool {
+	peers := make(map[string]map[netip.Prefix]bool)
+	add := func(id string, prefix netip.Prefix) {
+		if peers[id] == nil {
+			peers[id] = make(map[netip.Prefix]bool)
+		}
+		if prefix.IsValid() {
+			peers[id][prefix] = true
+		}
+	}
+	for _, id := range cfg.TrustedPeers {
+		add(id, netip.Prefix{})
+	}
+	for id, prefix := range cfg.PeersRouteTable {
+		add(id, peerPrefix(prefix))
+	}
+	for id, prefixes := range cfg.PeersSubnets {
+		add(id, netip.Prefix{})
+		for _, prefix := range prefixes {
+			add(id, prefix.Masked())
+		}
+	}
+	return peers
+}
+
+// restartFields return the names of changed settings which can't be applied at runtime
+func (e *Engine) restartFields(cfg *config.Config) []string {
+	var fields []string
+	cur, next := reflect.ValueOf(e.cfg).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		if !field.IsExported() || reloadableFields[field.Name] {
+			continue
+		}
+		// the address is managed by IPAM in auto address mode
+		if e.isAutoAddress() && (field.Name == "LocalAddr" || field.Name == "AddressClaimedAt") {
+			continue
+		}
+		if !reflect.DeepEqual(cur.Field(i).Interface(), next.Field(i).Interface()) {
+			fields = append(fields, field.Name)
+		}
+	}
+
+	if !e.relaySource && !reflect.DeepEqual(e.cfg.Relays, cfg.Relays) {
+		fields = append(fields, "Relays")
+	}
+	if !reflect.DeepEqual(logOutputs(e.cfg.LogConfigs), logOutputs(cfg.LogConfigs)) {
+		fields = append(fields, "LogConfigs")
+	}
+	return fields
+}
+
+// logOutputs strip the levels of configs, only levels can be changed at runtime
+func logOutputs(configs []mlog.CoreConfig) []mlog.CoreConfig {
+	outputs := make([]mlog.CoreConfig, len(configs))
+	for i, c := range configs {
+		c.Level = ""
+		outputs[i] = c
+	}
+	return outputs
+}
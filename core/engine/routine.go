@@ -1,11 +1,17 @@
 package engine
 
 import (
+	"net/netip"
+
+	"github.com/libp2p/go-cidranger/net"
+	"github.com/wlynxg/NetHive/core/device"
+	"github.com/wlynxg/NetHive/core/firewall"
 	"github.com/wlynxg/NetHive/core/protocol"
+	"github.com/wlynxg/NetHive/core/stack"
 )
 
-// RoutineTUNReader loop to read packets from TUN
-func (e *Engine) RoutineTUNReader() {
+// RoutineTUNReader loop to read packets from a TUN queue
+func (e *Engine) RoutineTUNReader(queue device.Queue, devReader PacketChan) {
 	var (
 		buff []byte
 		err  error
@@ -13,7 +19,7 @@ func (e *Engine) RoutineTUNReader() {
 	)
 	for {
 		buff = e.bufferPool.Get(BuffSize)
-		n, err = e.device.Read(buff)
+		n, err = queue.Read(buff)
 		if err != nil {
 			e.bufferPool.Put(buff)
 			e.log.Warnf("[RoutineTUNReader]: %s", err)
@@ -38,7 +44,7 @@ func (e *Engine) RoutineTUNReader() {
 		protocol.ReleaseIP(ip)
 		payload.Data = buff[:n]
 		select {
-		case e.devReader <- payload:
+		case devReader <- payload:
 		default:
 			e.log.Warnf("[RoutineTUNReader] drop packet: %s, because the sending queue is already full", payload.Dst)
 			e.bufferPool.Put(payload.Data)
@@ -47,15 +53,15 @@ func (e *Engine) RoutineTUNReader() {
 	}
 }
 
-// RoutineTUNWriter loop writing packets to TUN
-func (e *Engine) RoutineTUNWriter() {
+// RoutineTUNWriter loop writing packets to a TUN queue
+func (e *Engine) RoutineTUNWriter(queue device.Queue, devWriter PacketChan) {
 	var (
 		payload *Payload
 		err     error
 	)
 
-	for payload = range e.devWriter {
-		_, err = e.device.Write(payload.Data)
+	for payload = range devWriter {
+		_, err = queue.Write(payload.Data)
 		e.bufferPool.Put(payload.Data)
 		e.payloadPool.Put(payload)
 
@@ -67,14 +73,10 @@ func (e *Engine) RoutineTUNWriter() {
 }
 
 // RoutineRouteTableWriter loop sending the data packet to the corresponding channel according to the routing table
-func (e *Engine) RoutineRouteTableWriter() {
-	var (
-		payload *Payload
-		ok      bool
-		conn    PacketChan
-	)
+func (e *Engine) RoutineRouteTableWriter(devReader PacketChan) {
+	var payload *Payload
 
-	for payload = range e.devReader {
+	for payload = range devReader {
 		if (payload.Dst.IsLinkLocalMulticast() || payload.Dst.IsMulticast()) && e.cfg.EnableBroadcast {
 			//e.routeTable.m.Range(func(key string, value netip.Prefix) bool {
 			//	conn, ok := e.routeTable.id.Load(key)
@@ -98,27 +100,90 @@ func (e *Engine) RoutineRouteTableWriter() {
 			continue
 		}
 
-		conn, ok = e.routeTable.addr.Load(payload.Dst)
-		if !ok {
-			c, err := e.addConnByDst(payload.Dst)
-			if err != nil {
-				e.log.Warnf("[RoutineRouteTableWriter] drop packet: %s, because %s", payload.Dst, err)
-				continue
-			}
-			conn = c
+		id, err := e.peerByDst(payload.Dst)
+		if err != nil {
+			e.log.Warnf("[RoutineRouteTableWriter] drop packet: %s, because %s", payload.Dst, err)
+			e.dropped.Add(1)
+			e.bufferPool.Put(payload.Data)
+			e.payloadPool.Put(payload)
+			continue
 		}
 
-		if conn == nil {
+		if !e.allowPacket(id, payload.Data) {
+			e.dropped.Add(1)
+			e.bufferPool.Put(payload.Data)
+			e.payloadPool.Put(payload)
 			continue
 		}
 
+		conn := e.session(id, nil).queue
+
 		select {
 		case conn <- payload:
 		default:
 			e.log.Warnf("[RoutineRouteTableWriter] drop packet: %s, because the sending queue is already full", payload.Dst)
+			e.dropped.Add(1)
 			e.bufferPool.Put(payload.Data)
 			e.payloadPool.Put(payload)
 
 		}
 	}
 }
+
+// allowPacket report whether the firewall allows the packet sent to peer id
+func (e *Engine) allowPacket(id string, packet []byte) bool {
+	if e.firewall.Load() == nil {
+		return true
+	}
+
+	ip, err := protocol.ParseIP(packet)
+	if err != nil {
+		return false
+	}
+	defer protocol.ReleaseIP(ip)
+
+	if !e.filter(id, firewall.Outbound, ip, len(packet)) {
+		e.log.Debugf("firewall drop packet %s -> %s of peer %s", ip.Src(), ip.Dst(), id)
+		return false
+	}
+	return true
+}
+
+// receivePacket copy a packet received from peers and send it to the device
+func (e *Engine) receivePacket(packet []byte) {
+	payload := e.payloadPool.Get()
+	payload.Data = e.bufferPool.Get(len(packet))
+	copy(payload.Data, packet)
+	e.writeDev(payload)
+}
+
+// writeDev send the packet received from peers to the device queue of its flow,
+// packets of the same flow always use the same queue to keep them in order
+func (e *Engine) writeDev(payload *Payload) {
+	ip, err := protocol.ParseIP(payload.Data)
+	if err != nil {
+		e.log.Warnf("[writeDev] drop packet, because %s", err)
+		e.bufferPool.Put(payload.Data)
+		e.payloadPool.Put(payload)
+		return
+	}
+	payload.Src = ip.Src()
+	payload.Dst = ip.Dst()
+	protocol.ReleaseIP(ip)
+
+	e.devWriter[e.flowQueue(payload)] <- payload
+}
+
+// flowQueue return the index of the device queue used by the flow of payload
+func (e *Engine) flowQueue(payload *Payload) int {
+	if len(e.devWriter) == 1 {
+		return 0
+	}
+
+	version := net.IPv4
+	if payload.Src.Is6() {
+		version = net.IPv6
+	}
+	hash := stack.NetHash(version, netip.AddrPortFrom(payload.Src, 0), netip.AddrPortFrom(payload.Dst, 0))
+	return int(uint32(hash) % uint32(len(e.devWriter)))
+}
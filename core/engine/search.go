@@ -47,20 +47,42 @@ func (e *Engine) searchByCache(ctx context.Context, id peer.ID, ch chan peer.Add
 	e.log.Debugf("fail to search %s by static", id)
 }
 
+// searchByDHT look up the peer by DHT peer routing, then among the nodes advertising the
+// discovery namespace, which finds peers missing from the routing tables, e.g. DHT clients behind NAT
 func (e *Engine) searchByDHT(ctx context.Context, id peer.ID, ch chan peer.AddrInfo) {
-	pch, err := e.discovery.FindPeers(ctx, id.String())
-	if err != nil {
-		err := e.connectBootstraps()
-		if err != nil {
+	info, err := e.dht.FindPeer(ctx, id)
+	if err == nil && len(info.Addrs) > 0 {
+		e.log.Debugf("search %s info from DHT: %v", id, info)
+		select {
+		case <-ctx.Done():
+		case ch <- info:
+		}
+		return
+	}
+	e.log.Debugf("fail to search %s by DHT peer routing: %v", id, err)
+	if e.dht.RoutingTable().Size() == 0 {
+		if err := e.connectBootstraps(); err != nil {
 			e.log.Debugf("fail to reconnect bootstrap: %v", err)
 		}
+	}
+
+	ns := e.discoveryNamespace()
+	if ns == "" {
+		return
+	}
+	pch, err := e.discovery.FindPeers(ctx, ns)
+	if err != nil {
 		e.log.Debugf("fail to search %s by DHT: %v", id, err)
-	} else {
-		for info := range pch {
-			e.log.Debugf("search %s info from DHT: %v", id, info)
-			if id == info.ID && len(info.Addrs) > 0 {
-				ch <- info
+		return
+	}
+	for info := range pch {
+		if id == info.ID && len(info.Addrs) > 0 {
+			e.log.Debugf("search %s info from DHT namespace: %v", id, info)
+			select {
+			case <-ctx.Done():
+			case ch <- info:
 			}
+			return
 		}
 	}
 }
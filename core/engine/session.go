@@ -0,0 +1,459 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/wlynxg/NetHive/core/firewall"
+	"github.com/wlynxg/NetHive/core/protocol"
+)
+
+const (
+	SessionMinBackoff = time.Second
+	SessionMaxBackoff = time.Minute
+)
+
+var (
+	ErrSessionReplaced = errors.New("stream replaced by a new stream")
+)
+
+type SessionState int32
+
+const (
+	// SessionConnecting the session is searching and dialing the peer
+	SessionConnecting SessionState = iota
+	// SessionUp the session has a working stream to the peer
+	SessionUp
+	// SessionBackoff the last attempt failed, the session is waiting to redial
+	SessionBackoff
+	// SessionDown the session has stopped
+	SessionDown
+	// SessionDegraded the session works on a relayed connection, which is slow and limited by the relay
+	SessionDegraded
+)
+
+// Working report whether packets can be sent in the state
+func (s SessionState) Working() bool {
+	return s == SessionUp || s == SessionDegraded
+}
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionConnecting:
+		return "connecting"
+	case SessionUp:
+		return "up"
+	case SessionBackoff:
+		return "backoff"
+	case SessionDown:
+		return "down"
+	case SessionDegraded:
+		return "degraded"
+	}
+	return "unknown"
+}
+
+// PeerSession is the only owner of the vpn streams to a peer, for both outbound
+// streams dialed by itself and inbound streams accepted by VPNHandler.
+// When the stream breaks, it redials with exponential backoff, packets waiting
+// in queue are kept across reconnects.
+type PeerSession struct {
+	e       *Engine
+	id      string
+	queue   PacketChan
+	inbound chan network.Stream
+	// streams on a direct connection replacing a relayed one
+	migrate   chan network.Stream
+	migrating atomic.Bool
+	probing   atomic.Bool
+	state     atomic.Int32
+	// PeerID derived IPv6 address of the peer
+	addr6 netip.Addr
+
+	txPackets, txBytes atomic.Uint64
+	rxPackets, rxBytes atomic.Uint64
+	dropped, spoofed   atomic.Uint64
+
+	mu sync.Mutex
+	// stream in use, nil if the session is down, and the traffic of its connection if it's limited
+	stream network.Stream
+	usage  *connUsage
+	// connections measured by the last probe, the best first
+	paths []pathProbe
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// session return the session of peer id, the session is created and started if
+// it doesn't exist. A non nil inbound stream is handed over to the session.
+func (e *Engine) session(id string, inbound network.Stream) *PeerSession {
+	s, ok := e.routeTable.id.Load(id)
+	if !ok {
+		ns := &PeerSession{
+			e:       e,
+			id:      id,
+			queue:   make(PacketChan, ChanSize),
+			inbound: make(chan network.Stream, 1),
+			migrate: make(chan network.Stream, 1),
+		}
+		if pid, err := peer.Decode(id); err == nil {
+			ns.addr6 = PeerAddr6(pid)
+		}
+		ns.ctx, ns.cancel = context.WithCancel(e.ctx)
+
+		if actual, loaded := e.routeTable.id.LoadOrStore(id, ns); loaded {
+			ns.cancel()
+			s = actual.(*PeerSession)
+		} else {
+			// hand over the stream before starting, so the session doesn't dial needlessly
+			if inbound != nil {
+				ns.inbound <- inbound
+				inbound = nil
+			}
+			go ns.run()
+			s = ns
+		}
+	}
+
+	if inbound != nil {
+		s.attach(inbound)
+	}
+	return s
+}
+
+// SessionState return the state of the session to peer id
+func (e *Engine) SessionState(id string) (SessionState, bool) {
+	s, ok := e.routeTable.id.Load(id)
+	if !ok {
+		return SessionDown, false
+	}
+	return s.State(), true
+}
+
+func (s *PeerSession) ID() string { return s.id }
+
+func (s *PeerSession) State() SessionState {
+	return SessionState(s.state.Load())
+}
+
+func (s *PeerSession) Counters() Counters {
+	return Counters{
+		TxPackets: s.txPackets.Load(),
+		TxBytes:   s.txBytes.Load(),
+		RxPackets: s.rxPackets.Load(),
+		RxBytes:   s.rxBytes.Load(),
+		Dropped:   s.dropped.Load(),
+		Spoofed:   s.spoofed.Load(),
+	}
+}
+
+// Close stop the session, its stream is closed and queued packets are dropped
+func (s *PeerSession) Close() {
+	s.cancel()
+}
+
+func (s *PeerSession) setState(state SessionState) {
+	if old := SessionState(s.state.Swap(int32(state))); old != state {
+		s.e.log.Debugf("session [%s] state: %s -> %s", s.id, old, state)
+	}
+}
+
+func (s *PeerSession) setStream(stream network.Stream, usage *connUsage) {
+	s.mu.Lock()
+	s.stream, s.usage = stream, usage
+	s.mu.Unlock()
+}
+
+// attach hand over an inbound stream to the session
+func (s *PeerSession) attach(stream network.Stream) {
+	select {
+	case s.inbound <- stream:
+	case <-s.ctx.Done():
+		stream.Reset()
+	default:
+		// another inbound stream is waiting, the peer will retry
+		stream.Reset()
+	}
+}
+
+// localWins report whether the stream opened by the local peer survives when both
+// peers open streams at the same time, the peer with the smaller ID always wins
+func (s *PeerSession) localWins() bool {
+	return s.e.host.ID().String() < s.id
+}
+
+func (s *PeerSession) run() {
+	defer s.teardown()
+
+	var (
+		stream  network.Stream
+		err     error
+		backoff = SessionMinBackoff
+	)
+	for {
+		if stream == nil {
+			stream, err = s.connect()
+		}
+
+		if stream != nil {
+			backoff = SessionMinBackoff
+			if isRelayed(stream.Conn()) {
+				s.setState(SessionDegraded)
+			} else {
+				s.setState(SessionUp)
+			}
+			go s.probePaths()
+			stream, err = s.serve(stream)
+			if errors.Is(err, ErrSessionReplaced) || errors.Is(err, ErrRelayRenew) {
+				continue
+			}
+		}
+
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		s.e.log.Warnf("session [%s] broken: %v, retry after %s", s.id, err, backoff)
+		s.setState(SessionBackoff)
+		select {
+		case <-s.ctx.Done():
+			return
+		case stream = <-s.inbound:
+			continue
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > SessionMaxBackoff {
+			backoff = SessionMaxBackoff
+		}
+	}
+}
+
+// connect return the first stream from dialing the peer or accepting an inbound stream
+func (s *PeerSession) connect() (network.Stream, error) {
+	select {
+	case stream := <-s.inbound:
+		return stream, nil
+	default:
+	}
+
+	s.setState(SessionConnecting)
+
+	type dialResult struct {
+		stream network.Stream
+		err    error
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	result := make(chan dialResult, 1)
+	go func() {
+		stream, err := s.e.dial(ctx, s.id)
+		result <- dialResult{stream: stream, err: err}
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	case r := <-result:
+		return r.stream, r.err
+	case stream := <-s.inbound:
+		// simultaneous open, both peers must keep the same stream
+		if !s.localWins() {
+			go func() {
+				if r := <-result; r.stream != nil {
+					r.stream.Reset()
+				}
+			}()
+			return stream, nil
+		}
+
+		r := <-result
+		if r.err != nil {
+			return stream, nil
+		}
+		stream.Reset()
+		return r.stream, nil
+	}
+}
+
+// serve forward packets between queue and stream until the stream breaks.
+// If the peer replaces the stream, the new stream is returned with ErrSessionReplaced.
+func (s *PeerSession) serve(stream network.Stream) (network.Stream, error) {
+	pr := newPacketReader(stream)
+	pw := newPacketWriter(stream)
+	usage := s.e.connUsage(stream.Conn())
+	s.setStream(stream, usage)
+	defer s.setStream(nil, nil)
+
+	// relayed connections are reset by the relay when a limit is reached
+	var relayCheck <-chan time.Time
+	if usage != nil {
+		ticker := time.NewTicker(RelayCheckInterval)
+		defer ticker.Stop()
+		relayCheck = ticker.C
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		receive := func(packet []byte) {
+			if usage != nil {
+				usage.received.Add(uint64(len(packet)))
+			}
+			s.receive(packet)
+		}
+		for {
+			if err := pr.ReadPackets(receive); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	// flush is armed when the first packet enters an empty batch
+	flush := time.NewTimer(BatchFlushInterval)
+	flush.Stop()
+	defer flush.Stop()
+	armed := false
+	for {
+		select {
+		case <-s.ctx.Done():
+			stream.Reset()
+			return nil, s.ctx.Err()
+		case err := <-readErr:
+			stream.Reset()
+			return nil, err
+		case next := <-s.inbound:
+			// a new inbound stream means the peer has given up the current one,
+			// unless it is the loser of a simultaneous open
+			if s.localWins() && stream.Stat().Direction == network.DirOutbound {
+				next.Reset()
+				continue
+			}
+			pw.Flush()
+			drain(stream, readErr)
+			return next, ErrSessionReplaced
+		case <-relayCheck:
+			u := s.RelayUsage()
+			switch {
+			case u == nil:
+			case u.nearRelayLimit(RelayRenewRatio) && stream.Stat().Direction == network.DirOutbound:
+				// no direct connection is found, dial a new circuit instead of waiting for the reset
+				s.e.log.Infof("session [%s] renew relayed connection %s", s.id, stream.Conn().RemoteMultiaddr())
+				pw.Flush()
+				stream.Conn().Close()
+				return nil, ErrRelayRenew
+			case u.nearRelayLimit(RelayRefreshRatio):
+				go s.refreshRelay(stream)
+			}
+		case next := <-s.migrate:
+			// a stale stream of upgrade or refreshRelay must not move a direct session back to a relay
+			if next.Conn() == stream.Conn() || (isRelayed(next.Conn()) && !isRelayed(stream.Conn())) {
+				next.Reset()
+				continue
+			}
+			s.e.log.Infof("session [%s] migrate to connection %s", s.id, next.Conn().RemoteMultiaddr())
+			pw.Flush()
+			drain(stream, readErr)
+			return next, ErrSessionReplaced
+		case payload := <-s.queue:
+			err := pw.WritePacket(payload.Data)
+			if err == nil {
+				s.txPackets.Add(1)
+				s.txBytes.Add(uint64(len(payload.Data)))
+				if usage != nil {
+					usage.sent.Add(uint64(len(payload.Data)))
+				}
+			}
+			s.e.bufferPool.Put(payload.Data)
+			s.e.payloadPool.Put(payload)
+			if err != nil {
+				stream.Reset()
+				return nil, err
+			}
+			if !armed && pw.Buffered() > 0 {
+				flush.Reset(BatchFlushInterval)
+				armed = true
+			}
+		case <-flush.C:
+			armed = false
+			if err := pw.Flush(); err != nil {
+				stream.Reset()
+				return nil, err
+			}
+		}
+	}
+}
+
+// receive deliver a packet read from the stream, a peer which isn't a member
+// may only talk between its PeerID derived address and the local one,
+// a member may only send packets from the prefixes it owns
+func (s *PeerSession) receive(packet []byte) {
+	ip, err := protocol.ParseIP(packet)
+	if err != nil {
+		s.dropped.Add(1)
+		return
+	}
+	src, dst := ip.Src(), ip.Dst()
+	allowed := s.e.filter(s.id, firewall.Inbound, ip, len(packet))
+	protocol.ReleaseIP(ip)
+
+	if _, ok := s.e.routeTable.m.Load(s.id); !ok {
+		if !s.e.isOverlay6(src) || src != s.addr6 || dst != s.e.addr6 {
+			s.e.log.Debugf("session [%s] drop packet %s -> %s from non-member peer", s.id, src, dst)
+			s.dropped.Add(1)
+			return
+		}
+	} else if !s.ownsSource(src) {
+		s.e.log.Debugf("session [%s] drop packet %s -> %s with spoofed source", s.id, src, dst)
+		s.dropped.Add(1)
+		s.spoofed.Add(1)
+		return
+	}
+
+	if !allowed {
+		s.e.log.Debugf("firewall drop packet %s -> %s of peer %s", src, dst, s.id)
+		s.dropped.Add(1)
+		return
+	}
+	s.rxPackets.Add(1)
+	s.rxBytes.Add(uint64(len(packet)))
+	s.e.receivePacket(packet)
+}
+
+// ownsSource report whether src belongs to the peer, that is its PeerID derived
+// address or an address whose longest matching prefix is owned by the peer
+func (s *PeerSession) ownsSource(src netip.Addr) bool {
+	if src == s.addr6 {
+		return true
+	}
+	_, owner, ok := s.e.routeTable.prefix.Lookup(src)
+	return ok && owner == s.id
+}
+
+// teardown remove the stopped session from route table and release everything it holds
+func (s *PeerSession) teardown() {
+	s.setState(SessionDown)
+	s.e.routeTable.id.CompareAndDelete(s.id, s)
+
+	for {
+		select {
+		case stream := <-s.inbound:
+			stream.Reset()
+		case stream := <-s.migrate:
+			stream.Reset()
+		case payload := <-s.queue:
+			s.e.bufferPool.Put(payload.Data)
+			s.e.payloadPool.Put(payload)
+		default:
+			return
+		}
+	}
+}
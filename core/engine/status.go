@@ -0,0 +1,200 @@
+package engine
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/wlynxg/NetHive/core/route"
+)
+
+// Counters is the traffic statistics of a session or the whole engine
+type Counters struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+	Dropped   uint64
+	// Spoofed counts the dropped packets whose source address isn't owned by the sending peer
+	Spoofed uint64
+}
+
+type PeerStatus struct {
+	ID string
+	// Name is announced by the peer
+	Name string
+	// Prefix is invalid if the peer is a member without an address
+	Prefix netip.Prefix
+	Member bool
+	// Online report whether a heartbeat of the network member is received recently
+	Online    bool
+	State     string
+	Path      string
+	Connected bool
+	Addrs     []string
+	Counters  Counters
+	// Relay is nil unless the session is on a limited relayed connection
+	Relay *RelayUsage
+	// RTT is measured on the connection in use, Paths are all connections to the peer
+	RTT   time.Duration
+	Paths []PathQuality
+}
+
+type RouteStatus struct {
+	Prefix netip.Prefix
+	PeerID string
+}
+
+type DHTStatus struct {
+	Enabled bool
+	// RoutingTableSize is the number of peers in the routing table
+	RoutingTableSize int
+	// Mode is public or private, Server reports whether the node answers queries of other nodes
+	Mode   string
+	Server bool
+}
+
+type NetworkStatus struct {
+	Name  string
+	Admin string
+	// MemberListVersion is zero before the member list is received
+	MemberListVersion int64
+}
+
+type Status struct {
+	PeerID         string
+	PrivateNetwork bool
+	LocalAddr      netip.Prefix
+	LocalAddr6     netip.Addr
+	ListenAddrs    []string
+	DHT            DHTStatus
+	Network        NetworkStatus
+	Counters       Counters
+	// DNSDomain is served by MagicDNS, it's empty if MagicDNS is disabled
+	DNSDomain string
+}
+
+func (e *Engine) Status() Status {
+	s := Status{
+		PeerID:         e.host.ID().String(),
+		PrivateNetwork: e.cfg.PrivateNetworkKey != "",
+		LocalAddr:      e.cfg.LocalAddr,
+		// traffic of stopped sessions isn't counted
+		Counters:   Counters{Dropped: e.dropped.Load()},
+		LocalAddr6: e.addr6,
+	}
+	if e.cfg.EnableMagicDNS {
+		s.DNSDomain = e.dnsZone()
+	}
+	for _, addr := range e.host.Addrs() {
+		s.ListenAddrs = append(s.ListenAddrs, addr.String())
+	}
+	if e.cfg.NetworkName != "" {
+		s.Network = NetworkStatus{Name: e.cfg.NetworkName, Admin: e.cfg.NetworkAdmin, MemberListVersion: e.MemberListVersion()}
+	}
+	if e.dht != nil {
+		s.DHT.Enabled = true
+		s.DHT.RoutingTableSize = e.dht.RoutingTable().Size()
+		s.DHT.Mode = e.cfg.DHTMode
+		s.DHT.Server = e.dht.Mode() == dht.ModeServer
+	}
+
+	e.routeTable.id.Range(func(_ string, session *PeerSession) bool {
+		c := session.Counters()
+		s.Counters.TxPackets += c.TxPackets
+		s.Counters.TxBytes += c.TxBytes
+		s.Counters.RxPackets += c.RxPackets
+		s.Counters.RxBytes += c.RxBytes
+		s.Counters.Dropped += c.Dropped
+		s.Counters.Spoofed += c.Spoofed
+		return true
+	})
+	return s
+}
+
+// Peers return the status of member peers and peers with a session, sorted by ID
+func (e *Engine) Peers() []PeerStatus {
+	peers := make(map[string]*PeerStatus)
+	e.routeTable.m.Range(func(id string, prefix netip.Prefix) bool {
+		peers[id] = &PeerStatus{ID: id, Prefix: prefix, Member: true, State: SessionDown.String(), Path: PathNone.String()}
+		return true
+	})
+	e.routeTable.id.Range(func(id string, session *PeerSession) bool {
+		p, ok := peers[id]
+		if !ok {
+			p = &PeerStatus{ID: id}
+			peers[id] = p
+		}
+		p.State = session.State().String()
+		p.Path = session.Path().String()
+		p.Relay = session.RelayUsage()
+		p.RTT = session.RTT()
+		p.Paths = session.Paths()
+		p.Counters = session.Counters()
+		return true
+	})
+
+	list := make([]PeerStatus, 0, len(peers))
+	for _, p := range peers {
+		p.Name = e.PeerName(p.ID)
+		p.Online = e.IsOnline(p.ID)
+		if pid, err := peer.Decode(p.ID); err == nil {
+			for _, conn := range e.host.Network().ConnsToPeer(pid) {
+				p.Connected = true
+				p.Addrs = append(p.Addrs, conn.RemoteMultiaddr().String())
+			}
+		}
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Routes return the prefixes of the route table, sorted by prefix
+func (e *Engine) Routes() []RouteStatus {
+	routes := []RouteStatus{}
+	e.routeTable.prefix.Range(func(prefix netip.Prefix, id string) bool {
+		routes = append(routes, RouteStatus{Prefix: prefix, PeerID: id})
+		return true
+	})
+	sort.Slice(routes, func(i, j int) bool {
+		if c := routes[i].Prefix.Addr().Compare(routes[j].Prefix.Addr()); c != 0 {
+			return c < 0
+		}
+		return routes[i].Prefix.Bits() < routes[j].Prefix.Bits()
+	})
+	return routes
+}
+
+// AddPeerRoute route prefix to peer id at runtime, the peer becomes a member
+func (e *Engine) AddPeerRoute(id string, prefix netip.Prefix) error {
+	if _, err := peer.Decode(id); err != nil {
+		return err
+	}
+	if !prefix.IsValid() {
+		return errors.New("invalid prefix")
+	}
+	if e.device == nil {
+		return errors.New("engine isn't running")
+	}
+	name, err := e.device.Name()
+	if err != nil {
+		return err
+	}
+
+	e.routeTable.m.LoadOrStore(id, netip.Prefix{})
+	return e.addPeerPrefix(name, id, prefix.Masked())
+}
+
+// DelPeerRoute remove prefix from the route table at runtime
+func (e *Engine) DelPeerRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if _, ok := e.routeTable.prefix.Del(prefix); !ok {
+		return route.ErrNotFound
+	}
+	e.delPeerRoute(prefix)
+	return nil
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"net/netip"
+
+	"github.com/wlynxg/NetHive/pkgs/command"
+	"github.com/wlynxg/NetHive/pkgs/system"
+)
+
+// enableSubnetRouter make this node the gateway of the LAN prefixes in AdvertiseRoutes,
+// packets from the overlay to these prefixes are forwarded by the kernel to the physical network
+func (e *Engine) enableSubnetRouter(dev string) error {
+	if len(e.cfg.AdvertiseRoutes) == 0 {
+		return nil
+	}
+	e.log.Infof("advertise routes: %s", e.cfg.AdvertiseRoutes)
+
+	for _, prefix := range e.cfg.AdvertiseRoutes {
+		if e.cfg.EnableIPForward {
+			if err := e.enableIPForward(dev, prefix.Addr().Is6()); err != nil {
+				return err
+			}
+		}
+
+		if e.cfg.EnableMasquerade {
+			if err := e.masquerade(e.cfg.LocalAddr.Masked(), prefix.Masked()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enableIPForward turn on the kernel forwarding of the address family and accept
+// the forwarded packets of dev, everything is restored when the engine exits
+func (e *Engine) enableIPForward(dev string, v6 bool) error {
+	key := "net.ipv4.ip_forward"
+	if v6 {
+		key = "net.ipv6.conf.all.forwarding"
+	}
+	if e.forwarding[key] {
+		return nil
+	}
+
+	old, err := system.SetSysctl(key, "1")
+	if err != nil {
+		return err
+	}
+	e.forwarding[key] = true
+	e.addCleanup(func() {
+		if _, err := system.SetSysctl(key, old); err != nil {
+			e.log.Warnf("fail to restore %s: %v", key, err)
+		}
+	})
+	e.log.Infof("enable %s", key)
+
+	rules := [][]string{
+		{"-i", dev, "-j", "ACCEPT"},
+		{"-o", dev, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	for _, rule := range rules {
+		if err := command.IPTablesAppend(v6, "filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+		rule := rule
+		e.addCleanup(func() {
+			if err := command.IPTablesDelete(v6, "filter", "FORWARD", rule...); err != nil {
+				e.log.Warnf("fail to delete forward rule %s: %v", rule, err)
+			}
+		})
+	}
+	return nil
+}
+
+// masquerade rewrite the source of packets from src to dst with the address of the outgoing interface
+func (e *Engine) masquerade(src, dst netip.Prefix) error {
+	if src.Addr().Is6() != dst.Addr().Is6() {
+		e.log.Warnf("skip masquerade %s -> %s, because of different address families", src, dst)
+		return nil
+	}
+
+	rule := []string{"-s", src.String()}
+	if dst.Bits() > 0 {
+		rule = append(rule, "-d", dst.String())
+	}
+	rule = append(rule, "-j", "MASQUERADE")
+
+	v6 := dst.Addr().Is6()
+	if err := command.IPTablesAppend(v6, "nat", "POSTROUTING", rule...); err != nil {
+		return err
+	}
+	e.addCleanup(func() {
+		if err := command.IPTablesDelete(v6, "nat", "POSTROUTING", rule...); err != nil {
+			e.log.Warnf("fail to delete masquerade rule %s: %v", rule, err)
+		}
+	})
+	e.log.Infof("masquerade %s -> %s", src, dst)
+	return nil
+}
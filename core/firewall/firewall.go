@@ -0,0 +1,220 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/wlynxg/NetHive/core/config"
+	"github.com/wlynxg/NetHive/core/protocol"
+)
+
+type Direction int
+
+const (
+	// Inbound packets are received from peers
+	Inbound Direction = iota + 1
+	// Outbound packets are sent to peers
+	Outbound
+)
+
+const groupPrefix = "group:"
+
+// Firewall decides whether a packet exchanged with a peer is allowed, it's immutable
+// once created, so it can be replaced as a whole on reload
+type Firewall struct {
+	defaultAllow bool
+	stateful     bool
+	rules        []rule
+}
+
+type rule struct {
+	allow     bool
+	direction Direction
+	// nil matches all peers
+	peers    map[string]struct{}
+	protocol string
+	dst      []netip.Prefix
+	ports    []portRange
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+// New compile acl, a nil Firewall is returned if it allows everything
+func New(acl config.ACL) (*Firewall, error) {
+	f := &Firewall{stateful: acl.Stateful}
+	switch acl.DefaultPolicy {
+	case "", config.ACLAllow:
+		f.defaultAllow = true
+	case config.ACLDeny:
+	default:
+		return nil, fmt.Errorf("unknown ACL default policy: %s", acl.DefaultPolicy)
+	}
+
+	for i, r := range acl.Rules {
+		compiled, err := compile(acl, r)
+		if err != nil {
+			return nil, fmt.Errorf("ACL rule %d: %w", i, err)
+		}
+		f.rules = append(f.rules, compiled)
+	}
+
+	if f.defaultAllow && !f.stateful && len(f.rules) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func compile(acl config.ACL, r config.ACLRule) (rule, error) {
+	var c rule
+	switch r.Action {
+	case config.ACLAllow:
+		c.allow = true
+	case config.ACLDeny:
+	default:
+		return c, fmt.Errorf("unknown action: %s", r.Action)
+	}
+
+	switch r.Direction {
+	case "":
+	case "in":
+		c.direction = Inbound
+	case "out":
+		c.direction = Outbound
+	default:
+		return c, fmt.Errorf("unknown direction: %s", r.Direction)
+	}
+
+	for _, p := range r.Peers {
+		if c.peers == nil {
+			c.peers = make(map[string]struct{})
+		}
+		if name, ok := strings.CutPrefix(p, groupPrefix); ok {
+			members, ok := acl.Groups[name]
+			if !ok {
+				return c, fmt.Errorf("unknown group: %s", name)
+			}
+			for _, id := range members {
+				c.peers[id] = struct{}{}
+			}
+			continue
+		}
+		c.peers[p] = struct{}{}
+	}
+
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp":
+		c.protocol = r.Protocol
+	default:
+		return c, fmt.Errorf("unknown protocol: %s", r.Protocol)
+	}
+	if len(r.Ports) > 0 && r.Protocol == "icmp" {
+		return c, fmt.Errorf("icmp has no ports")
+	}
+
+	for _, prefix := range r.Dst {
+		c.dst = append(c.dst, prefix.Masked())
+	}
+	for _, p := range r.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return c, err
+		}
+		c.ports = append(c.ports, pr)
+	}
+	return c, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	end := start
+	if isRange {
+		if end, err = strconv.ParseUint(to, 10, 16); err != nil || end < start {
+			return portRange{}, fmt.Errorf("invalid port range: %s", s)
+		}
+	}
+	return portRange{from: uint16(start), to: uint16(end)}, nil
+}
+
+// Stateful report whether the replies of allowed flows are tracked and allowed
+func (f *Firewall) Stateful() bool {
+	return f != nil && f.stateful
+}
+
+// Allow report whether the packet exchanged with peer in direction is allowed, a nil Firewall allows everything.
+// A stateful firewall denies inbound packets matching no rule, replies are left to the connection tracking.
+func (f *Firewall) Allow(peer string, direction Direction, ip protocol.IP) bool {
+	if f == nil {
+		return true
+	}
+	for i := range f.rules {
+		if f.rules[i].match(peer, direction, ip) {
+			return f.rules[i].allow
+		}
+	}
+	if f.stateful && direction == Inbound {
+		return false
+	}
+	return f.defaultAllow
+}
+
+func (r *rule) match(peer string, direction Direction, ip protocol.IP) bool {
+	if r.direction != 0 && r.direction != direction {
+		return false
+	}
+	if r.peers != nil {
+		if _, ok := r.peers[peer]; !ok {
+			return false
+		}
+	}
+
+	switch r.protocol {
+	case "tcp":
+		if ip.Protocol() != protocol.ProtocolTCP {
+			return false
+		}
+	case "udp":
+		if ip.Protocol() != protocol.ProtocolUDP {
+			return false
+		}
+	case "icmp":
+		if ip.Protocol() != protocol.ProtocolICMP && ip.Protocol() != protocol.ProtocolICMPv6 {
+			return false
+		}
+	}
+
+	if len(r.dst) > 0 && !containsAddr(r.dst, ip.Dst()) {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		// non-first fragments and other protocols have no port to match
+		if ip.Fragment() || (ip.Protocol() != protocol.ProtocolTCP && ip.Protocol() != protocol.ProtocolUDP) {
+			return false
+		}
+		port := ip.DstPort()
+		for _, pr := range r.ports {
+			if port >= pr.from && port <= pr.to {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/wlynxg/NetHive/core/config"
+	"github.com/wlynxg/NetHive/core/protocol"
+)
+
+// packet4 build an IPv4 packet with a TCP or UDP header
+func packet4(proto uint8, src, dst string, dstPort uint16) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[8] = 64
+	b[9] = proto
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(b[12:], s[:])
+	copy(b[16:], d[:])
+	binary.BigEndian.PutUint16(b[20:], 40000)
+	binary.BigEndian.PutUint16(b[22:], dstPort)
+	return b
+}
+
+func TestFirewall(t *testing.T) {
+	acl := config.ACL{
+		DefaultPolicy: config.ACLDeny,
+		Groups:        map[string][]string{"admins": {"admin"}},
+		Rules: []config.ACLRule{
+			{Action: config.ACLAllow, Peers: []string{"group:admins"}},
+			{Action: config.ACLDeny, Direction: "in", Protocol: "tcp", Ports: []string{"22"}},
+			{Action: config.ACLAllow, Protocol: "tcp", Dst: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, Ports: []string{"22", "8000-8100"}},
+			{Action: config.ACLAllow, Direction: "out", Protocol: "icmp"},
+		},
+	}
+	fw, err := New(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		peer      string
+		direction Direction
+		packet    []byte
+		want      bool
+	}{
+		{"group", "admin", Inbound, packet4(protocol.ProtocolUDP, "10.0.0.2", "10.0.0.1", 53), true},
+		{"deny ssh inbound", "other", Inbound, packet4(protocol.ProtocolTCP, "10.0.0.2", "10.0.0.1", 22), false},
+		{"allow ssh outbound", "other", Outbound, packet4(protocol.ProtocolTCP, "10.0.0.1", "10.0.0.2", 22), true},
+		{"port range", "other", Inbound, packet4(protocol.ProtocolTCP, "10.0.0.2", "10.0.0.1", 8080), true},
+		{"port out of range", "other", Inbound, packet4(protocol.ProtocolTCP, "10.0.0.2", "10.0.0.1", 8101), false},
+		{"dst mismatch", "other", Outbound, packet4(protocol.ProtocolTCP, "10.0.0.1", "10.0.1.2", 8080), false},
+		{"udp default", "other", Inbound, packet4(protocol.ProtocolUDP, "10.0.0.2", "10.0.0.1", 8080), false},
+		{"icmp outbound", "other", Outbound, packet4(protocol.ProtocolICMP, "10.0.0.1", "10.0.0.2", 0), true},
+		{"icmp inbound", "other", Inbound, packet4(protocol.ProtocolICMP, "10.0.0.2", "10.0.0.1", 0), false},
+	}
+	for _, tt := range tests {
+		ip, err := protocol.ParseIP(tt.packet)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := fw.Allow(tt.peer, tt.direction, ip); got != tt.want {
+			t.Errorf("%s: Allow() = %v, want %v", tt.name, got, tt.want)
+		}
+		protocol.ReleaseIP(ip)
+	}
+}
+
+func TestFirewallInvalid(t *testing.T) {
+	for _, acl := range []config.ACL{
+		{DefaultPolicy: "drop"},
+		{Rules: []config.ACLRule{{Action: "reject"}}},
+		{Rules: []config.ACLRule{{Action: config.ACLAllow, Peers: []string{"group:missing"}}}},
+		{Rules: []config.ACLRule{{Action: config.ACLAllow, Protocol: "icmp", Ports: []string{"22"}}}},
+		{Rules: []config.ACLRule{{Action: config.ACLAllow, Ports: []string{"100-10"}}}},
+	} {
+		if _, err := New(acl); err == nil {
+			t.Errorf("New(%+v) succeeded, want error", acl)
+		}
+	}
+
+	if fw, err := New(config.ACL{DefaultPolicy: config.ACLAllow}); err != nil || fw != nil {
+		t.Errorf("New() = %v, %v, want nil firewall", fw, err)
+	}
+}
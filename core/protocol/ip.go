@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"encoding/binary"
 	"errors"
 	"net/netip"
 	"sync"
@@ -10,6 +11,30 @@ var (
 	ErrInvalidIPPacket = errors.New("invalid IP packet")
 )
 
+// IP protocol numbers
+const (
+	ProtocolICMP   = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// TCP flags
+const (
+	TCPFin = 0x01
+	TCPSyn = 0x02
+	TCPRst = 0x04
+	TCPAck = 0x10
+)
+
+// ICMP echo types
+const (
+	ICMPEchoReply     = 0
+	ICMPEchoRequest   = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+)
+
 var ipPacketPool = sync.Pool{
 	New: func() interface{} {
 		return &IPPacket{}
@@ -20,17 +45,43 @@ type IP interface {
 	Version() int
 	Src() netip.Addr
 	Dst() netip.Addr
+	// Protocol is the L4 protocol number, after IPv6 extension headers
+	Protocol() uint8
+	// Fragment report whether the packet is a non-first fragment, which carries no L4 header
+	Fragment() bool
+	// SrcPort and DstPort are zero unless the packet is TCP or UDP
+	SrcPort() uint16
+	DstPort() uint16
+	// TCPFlags is zero unless the packet is TCP
+	TCPFlags() uint8
+	// ICMPType is zero unless the packet is ICMP or ICMPv6, ICMPID is the identifier of echo messages
+	ICMPType() uint8
+	ICMPID() uint16
 }
 
 type IPPacket struct {
-	version int
-	src     netip.Addr
-	dst     netip.Addr
+	version  int
+	src      netip.Addr
+	dst      netip.Addr
+	protocol uint8
+	fragment bool
+	srcPort  uint16
+	dstPort  uint16
+	tcpFlags uint8
+	icmpType uint8
+	icmpID   uint16
 }
 
 func (ip *IPPacket) Version() int    { return ip.version }
 func (ip *IPPacket) Src() netip.Addr { return ip.src }
 func (ip *IPPacket) Dst() netip.Addr { return ip.dst }
+func (ip *IPPacket) Protocol() uint8 { return ip.protocol }
+func (ip *IPPacket) Fragment() bool  { return ip.fragment }
+func (ip *IPPacket) SrcPort() uint16 { return ip.srcPort }
+func (ip *IPPacket) DstPort() uint16 { return ip.dstPort }
+func (ip *IPPacket) TCPFlags() uint8 { return ip.tcpFlags }
+func (ip *IPPacket) ICMPType() uint8 { return ip.icmpType }
+func (ip *IPPacket) ICMPID() uint16  { return ip.icmpID }
 
 func ParseIP(buff []byte) (IP, error) {
 	if len(buff) < 20 {
@@ -39,7 +90,7 @@ func ParseIP(buff []byte) (IP, error) {
 
 	version := int(buff[0] >> 4)
 	ip := ipPacketPool.Get().(*IPPacket)
-	ip.version = version
+	*ip = IPPacket{version: version}
 
 	var err error
 	switch version {
@@ -72,6 +123,15 @@ func parseIPv4(ip *IPPacket, buff []byte) error {
 		return ErrInvalidIPPacket
 	}
 
+	ip.protocol = buff[9]
+	ip.fragment = binary.BigEndian.Uint16(buff[6:8])&0x1fff != 0
+	headerLen := int(buff[0]&0x0f) * 4
+	if headerLen < 20 || headerLen > len(buff) {
+		return ErrInvalidIPPacket
+	}
+	if !ip.fragment {
+		parseL4(ip, buff[headerLen:])
+	}
 	return nil
 }
 
@@ -91,9 +151,55 @@ func parseIPv6(ip *IPPacket, buff []byte) error {
 		return ErrInvalidIPPacket
 	}
 
+	// skip extension headers to find the L4 protocol
+	next, offset := buff[6], 40
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if offset+8 > len(buff) {
+				return ErrInvalidIPPacket
+			}
+			next, offset = buff[offset], offset+(int(buff[offset+1])+1)*8
+			continue
+		case 44: // fragment
+			if offset+8 > len(buff) {
+				return ErrInvalidIPPacket
+			}
+			ip.fragment = binary.BigEndian.Uint16(buff[offset+2:offset+4])&0xfff8 != 0
+			next, offset = buff[offset], offset+8
+			continue
+		}
+		break
+	}
+	if offset > len(buff) {
+		return ErrInvalidIPPacket
+	}
+
+	ip.protocol = next
+	if !ip.fragment {
+		parseL4(ip, buff[offset:])
+	}
 	return nil
 }
 
+func parseL4(ip *IPPacket, l4 []byte) {
+	switch ip.protocol {
+	case ProtocolTCP, ProtocolUDP:
+		if len(l4) >= 4 {
+			ip.srcPort = binary.BigEndian.Uint16(l4[0:2])
+			ip.dstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+		if ip.protocol == ProtocolTCP && len(l4) >= 14 {
+			ip.tcpFlags = l4[13]
+		}
+	case ProtocolICMP, ProtocolICMPv6:
+		if len(l4) >= 8 {
+			ip.icmpType = l4[0]
+			ip.icmpID = binary.BigEndian.Uint16(l4[4:6])
+		}
+	}
+}
+
 func ReleaseIP(ip IP) {
 	if ipPacket, ok := ip.(*IPPacket); ok {
 		ipPacketPool.Put(ipPacket)
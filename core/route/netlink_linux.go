@@ -0,0 +1,163 @@
+package route
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var seq atomic.Uint32
+
+type attr struct {
+	typ  uint16
+	data []byte
+}
+
+// request send a rtnetlink request and return the payload of all replies
+func request(typ uint16, flags int, body []byte, attrs []attr) ([]syscall.NetlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	for _, a := range attrs {
+		body = append(body, rtAttr(a)...)
+	}
+	hdr := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(body)),
+		Type:  typ,
+		Flags: uint16(unix.NLM_F_REQUEST | flags),
+		Seq:   seq.Add(1),
+	}
+	msg := append((*(*[unix.SizeofNlMsghdr]byte)(unsafe.Pointer(&hdr)))[:], body...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var (
+		replies []syscall.NetlinkMessage
+		buf     = make([]byte, 1<<16)
+	)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != hdr.Seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, syscall.EINVAL
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// acknowledgement of a request without reply
+				return replies, nil
+			default:
+				// copy the message since buf is reused
+				m.Data = append([]byte{}, m.Data...)
+				replies = append(replies, m)
+				if m.Header.Flags&unix.NLM_F_MULTI == 0 && flags&unix.NLM_F_ACK == 0 {
+					return replies, nil
+				}
+			}
+		}
+	}
+}
+
+// parseRoute convert a RTM_NEWROUTE message, ok is false for routes other than unicast
+func parseRoute(m syscall.NetlinkMessage) (r Route, ok bool, err error) {
+	if len(m.Data) < unix.SizeofRtMsg {
+		return r, false, syscall.EINVAL
+	}
+	rtm := (*unix.RtMsg)(unsafe.Pointer(&m.Data[0]))
+	if rtm.Type != unix.RTN_UNICAST {
+		return r, false, nil
+	}
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		return r, false, err
+	}
+
+	var dst netip.Addr
+	r.Table = int(rtm.Table)
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case unix.RTA_DST:
+			dst, _ = netip.AddrFromSlice(a.Value)
+		case unix.RTA_GATEWAY:
+			r.Gateway, _ = netip.AddrFromSlice(a.Value)
+		case unix.RTA_OIF:
+			if itf, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(a.Value))); err == nil {
+				r.Dev = itf.Name
+			}
+		case unix.RTA_PRIORITY:
+			r.Metric = int(binary.NativeEndian.Uint32(a.Value))
+		case unix.RTA_TABLE:
+			r.Table = int(binary.NativeEndian.Uint32(a.Value))
+		}
+	}
+
+	if !dst.IsValid() {
+		dst = netip.IPv6Unspecified()
+		if rtm.Family == unix.AF_INET {
+			dst = netip.IPv4Unspecified()
+		}
+	}
+	r.Dst = netip.PrefixFrom(dst, int(rtm.Dst_len))
+	return r, true, nil
+}
+
+func rtMsg(rtm unix.RtMsg) []byte {
+	return append([]byte{}, (*(*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&rtm)))[:]...)
+}
+
+func rtAttr(a attr) []byte {
+	length := unix.SizeofRtAttr + len(a.data)
+	b := make([]byte, rtaAlign(length))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(b[2:4], a.typ)
+	copy(b[unix.SizeofRtAttr:], a.data)
+	return b
+}
+
+func rtaAlign(length int) int {
+	return (length + unix.RTA_ALIGNTO - 1) & ^(unix.RTA_ALIGNTO - 1)
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func ifIndex(dev string) (int, error) {
+	itf, err := net.InterfaceByName(dev)
+	if err != nil {
+		return 0, err
+	}
+	return itf.Index, nil
+}
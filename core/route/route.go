@@ -1 +1,16 @@
 package route
+
+import (
+	"net/netip"
+)
+
+// Route is a kernel route entry
+type Route struct {
+	Dst netip.Prefix
+	// Gateway is invalid for on-link routes
+	Gateway netip.Addr
+	Dev     string
+	Metric  int
+	// Table is the main table if it's zero
+	Table int
+}
@@ -1,82 +1,160 @@
 package route
 
 import (
-	"net"
+	"errors"
 	"net/netip"
-	"syscall"
-	"unsafe"
 
-	"github.com/wlynxg/NetHive/pkgs/system"
+	"golang.org/x/sys/unix"
 )
 
-type RtEntry struct {
-	_       uint64
-	Dst     syscall.RawSockaddrInet4
-	Gateway syscall.RawSockaddrInet4
-	GenMask syscall.RawSockaddrInet4
-	Flags   uint16
-	_       uint16
-	_       uint64
-	Tos     byte
-	Class   byte
-	_       [3]uint16
-	Metric  int16
-	Dev     uintptr
-	Mtu     uint64
-	Window  uint64
-	IRtt    uint16
-}
+var (
+	ErrNotFound = errors.New("route not found")
+)
 
+// Add route target to dev, it fails if the route already exists
 func Add(dev string, target netip.Prefix) error {
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
-	if err != nil {
-		return err
-	}
-	defer syscall.Close(fd)
+	return AddRoute(Route{Dst: target, Dev: dev})
+}
+
+// Del remove the route of target from the main table
+func Del(target netip.Prefix) error {
+	return DelRoute(Route{Dst: target})
+}
+
+// AddRoute add r to the kernel, it fails if the route already exists
+func AddRoute(r Route) error {
+	return routeRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r)
+}
 
-	_, cidr, err := net.ParseCIDR(target.String())
+// ReplaceRoute add r to the kernel or replace the existing route of the same destination
+func ReplaceRoute(r Route) error {
+	return routeRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, r)
+}
+
+// DelRoute remove r from the kernel, unset fields of r match any route
+func DelRoute(r Route) error {
+	return routeRequest(unix.RTM_DELROUTE, 0, r)
+}
+
+// List return the unicast routes of the address family of all tables,
+// family is unix.AF_INET or unix.AF_INET6
+func List(family int) ([]Route, error) {
+	msgs, err := request(unix.RTM_GETROUTE, unix.NLM_F_DUMP, rtMsg(unix.RtMsg{Family: uint8(family)}), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	mask := cidr.Mask
 
-	rt := RtEntry{}
-	rt.Dst = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: target.Addr().As4()}
-	rt.GenMask = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte{mask[0], mask[1], mask[2], mask[3]}}
-	rt.Flags = syscall.RTF_UP
-	devName := [syscall.IFNAMSIZ]byte{}
-	copy(devName[:], dev)
-	rt.Dev = uintptr(unsafe.Pointer(&devName))
-	rtBytes := *(*[unsafe.Sizeof(rt)]byte)(unsafe.Pointer(&rt))
+	routes := make([]Route, 0, len(msgs))
+	for _, msg := range msgs {
+		r, ok, err := parseRoute(msg)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
 
-	err = system.Ioctl(uintptr(fd), syscall.SIOCADDRT, uintptr(unsafe.Pointer(&rtBytes[0])))
+// Get return the route used by the kernel to reach dst
+func Get(dst netip.Addr) (Route, error) {
+	rtm := unix.RtMsg{Family: family(dst), Dst_len: uint8(dst.BitLen())}
+	msgs, err := request(unix.RTM_GETROUTE, 0, rtMsg(rtm), []attr{{unix.RTA_DST, dst.AsSlice()}})
 	if err != nil {
-		return err
+		return Route{}, err
+	}
+	for _, msg := range msgs {
+		if r, ok, err := parseRoute(msg); err == nil && ok {
+			return r, nil
+		}
 	}
-	return nil
+	return Route{}, ErrNotFound
 }
 
-func Del(target netip.Prefix) error {
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+// Default return the default route of the main table with the lowest metric
+func Default(family int) (Route, error) {
+	routes, err := List(family)
 	if err != nil {
-		return err
+		return Route{}, err
 	}
-	defer syscall.Close(fd)
 
-	_, cidr, err := net.ParseCIDR(target.String())
-	if err != nil {
-		return err
+	var (
+		best  Route
+		found bool
+	)
+	for _, r := range routes {
+		if r.Table != unix.RT_TABLE_MAIN || r.Dst.Bits() != 0 || r.Dev == "" {
+			continue
+		}
+		if !found || r.Metric < best.Metric {
+			best, found = r, true
+		}
 	}
-	mask := cidr.Mask
+	if !found {
+		return Route{}, ErrNotFound
+	}
+	return best, nil
+}
 
-	rt := RtEntry{}
-	rt.Dst = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: target.Addr().As4()}
-	rt.GenMask = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte{mask[0], mask[1], mask[2], mask[3]}}
-	rtBytes := *(*[unsafe.Sizeof(rt)]byte)(unsafe.Pointer(&rt))
+func routeRequest(typ uint16, flags int, r Route) error {
+	dst := r.Dst.Masked()
+	if !dst.IsValid() {
+		return errors.New("invalid route destination")
+	}
 
-	err = system.Ioctl(uintptr(fd), syscall.SIOCDELRT, uintptr(unsafe.Pointer(&rtBytes[0])))
-	if err != nil {
-		return err
+	rtm := unix.RtMsg{
+		Family:   family(dst.Addr()),
+		Dst_len:  uint8(dst.Bits()),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	if !r.Gateway.IsValid() {
+		rtm.Scope = unix.RT_SCOPE_LINK
+	}
+	if typ == unix.RTM_DELROUTE {
+		rtm.Protocol = 0
+		rtm.Scope = unix.RT_SCOPE_NOWHERE
+		rtm.Type = 0
+	}
+
+	table := r.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	if table > 255 {
+		rtm.Table = unix.RT_TABLE_UNSPEC
+	} else {
+		rtm.Table = uint8(table)
+	}
+
+	attrs := []attr{
+		{unix.RTA_DST, dst.Addr().AsSlice()},
+		{unix.RTA_TABLE, uint32Bytes(uint32(table))},
+	}
+	if r.Gateway.IsValid() {
+		attrs = append(attrs, attr{unix.RTA_GATEWAY, r.Gateway.Unmap().AsSlice()})
+	}
+	if r.Dev != "" {
+		index, err := ifIndex(r.Dev)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, attr{unix.RTA_OIF, uint32Bytes(uint32(index))})
+	}
+	if r.Metric > 0 {
+		attrs = append(attrs, attr{unix.RTA_PRIORITY, uint32Bytes(uint32(r.Metric))})
+	}
+
+	_, err := request(typ, flags|unix.NLM_F_ACK, rtMsg(rtm), attrs)
+	return err
+}
+
+func family(addr netip.Addr) uint8 {
+	if addr.Is4() || addr.Is4In6() {
+		return unix.AF_INET
 	}
-	return nil
+	return unix.AF_INET6
 }
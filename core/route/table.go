@@ -0,0 +1,168 @@
+package route
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/libp2p/go-cidranger"
+)
+
+// Table is a longest prefix match routing table, every prefix is owned by a peer.
+// Lookup walks a path compressed trie, so its cost depends on the prefix length
+// rather than the number of peers.
+type Table struct {
+	mu     sync.RWMutex
+	ranger cidranger.Ranger
+	peers  map[string]map[netip.Prefix]struct{}
+}
+
+type tableEntry struct {
+	ipNet  net.IPNet
+	prefix netip.Prefix
+	peer   string
+}
+
+func (e *tableEntry) Network() net.IPNet { return e.ipNet }
+
+func NewTable() *Table {
+	return &Table{
+		ranger: cidranger.NewPCTrieRanger(),
+		peers:  make(map[string]map[netip.Prefix]struct{}),
+	}
+}
+
+// Add make peer the owner of prefix, the previous owner of the same prefix is replaced
+func (t *Table) Add(prefix netip.Prefix, peer string) error {
+	prefix = prefix.Masked()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old, ok := t.lookupExact(prefix); ok {
+		t.unindex(prefix, old)
+	}
+	if err := t.ranger.Insert(&tableEntry{ipNet: ipNet(prefix), prefix: prefix, peer: peer}); err != nil {
+		return err
+	}
+
+	prefixes, ok := t.peers[peer]
+	if !ok {
+		prefixes = make(map[netip.Prefix]struct{})
+		t.peers[peer] = prefixes
+	}
+	prefixes[prefix] = struct{}{}
+	return nil
+}
+
+// Del remove prefix and return its owner
+func (t *Table) Del(prefix netip.Prefix) (string, bool) {
+	prefix = prefix.Masked()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, err := t.ranger.Remove(ipNet(prefix))
+	if err != nil || entry == nil {
+		return "", false
+	}
+	peer := entry.(*tableEntry).peer
+	t.unindex(prefix, peer)
+	return peer, true
+}
+
+// DelPeer remove all prefixes owned by peer and return them
+func (t *Table) DelPeer(peer string) []netip.Prefix {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var removed []netip.Prefix
+	for prefix := range t.peers[peer] {
+		t.ranger.Remove(ipNet(prefix))
+		removed = append(removed, prefix)
+	}
+	delete(t.peers, peer)
+	return removed
+}
+
+// Lookup return the longest prefix containing addr and its owner
+func (t *Table) Lookup(addr netip.Addr) (netip.Prefix, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entries, err := t.ranger.ContainingNetworks(addr.Unmap().AsSlice())
+	if err != nil || len(entries) == 0 {
+		return netip.Prefix{}, "", false
+	}
+
+	// entries are ordered from the shortest prefix to the longest one
+	entry := entries[len(entries)-1].(*tableEntry)
+	return entry.prefix, entry.peer, true
+}
+
+// Owner return the owner of prefix, it's empty if prefix isn't in the table
+func (t *Table) Owner(prefix netip.Prefix) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	owner, _ := t.lookupExact(prefix.Masked())
+	return owner
+}
+
+// Prefixes return all prefixes owned by peer
+func (t *Table) Prefixes(peer string) []netip.Prefix {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	prefixes := make([]netip.Prefix, 0, len(t.peers[peer]))
+	for prefix := range t.peers[peer] {
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// Range calls f sequentially for each prefix and its owner, if f returns false, range stops the iteration.
+func (t *Table) Range(f func(prefix netip.Prefix, peer string) bool) {
+	t.mu.RLock()
+	var (
+		prefixes []netip.Prefix
+		peers    []string
+	)
+	for peer, owned := range t.peers {
+		for prefix := range owned {
+			prefixes = append(prefixes, prefix)
+			peers = append(peers, peer)
+		}
+	}
+	t.mu.RUnlock()
+
+	for i := range prefixes {
+		if !f(prefixes[i], peers[i]) {
+			return
+		}
+	}
+}
+
+func (t *Table) lookupExact(prefix netip.Prefix) (string, bool) {
+	for peer, owned := range t.peers {
+		if _, ok := owned[prefix]; ok {
+			return peer, true
+		}
+	}
+	return "", false
+}
+
+func (t *Table) unindex(prefix netip.Prefix, peer string) {
+	delete(t.peers[peer], prefix)
+	if len(t.peers[peer]) == 0 {
+		delete(t.peers, peer)
+	}
+}
+
+func ipNet(prefix netip.Prefix) net.IPNet {
+	addr := prefix.Addr().Unmap()
+	return net.IPNet{
+		IP:   addr.AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), addr.BitLen()),
+	}
+}
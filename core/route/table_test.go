@@ -0,0 +1,55 @@
+package route
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTableLookup(t *testing.T) {
+	table := NewTable()
+	table.Add(netip.MustParsePrefix("10.1.0.0/16"), "a")
+	table.Add(netip.MustParsePrefix("10.1.2.0/24"), "b")
+	table.Add(netip.MustParsePrefix("0.0.0.0/0"), "c")
+	table.Add(netip.MustParsePrefix("fd00::/8"), "d")
+
+	tests := []struct {
+		addr string
+		peer string
+	}{
+		{"10.1.0.0", "a"},
+		{"10.1.200.3", "a"},
+		{"10.1.2.9", "b"},
+		{"8.8.8.8", "c"},
+		{"fd00::1", "d"},
+	}
+	for _, tt := range tests {
+		_, peer, ok := table.Lookup(netip.MustParseAddr(tt.addr))
+		if !ok || peer != tt.peer {
+			t.Errorf("Lookup(%s) = %s, %v, want %s", tt.addr, peer, ok, tt.peer)
+		}
+	}
+
+	if _, _, ok := table.Lookup(netip.MustParseAddr("fe80::1")); ok {
+		t.Errorf("Lookup(fe80::1) should fail")
+	}
+}
+
+func TestTableOwner(t *testing.T) {
+	table := NewTable()
+	table.Add(netip.MustParsePrefix("10.1.0.0/16"), "a")
+	table.Add(netip.MustParsePrefix("10.2.0.0/16"), "a")
+	table.Add(netip.MustParsePrefix("10.1.0.0/16"), "b")
+
+	if n := len(table.Prefixes("a")); n != 1 {
+		t.Errorf("len(Prefixes(a)) = %d, want 1", n)
+	}
+	if removed := table.DelPeer("b"); len(removed) != 1 {
+		t.Errorf("DelPeer(b) removed %v, want 10.1.0.0/16", removed)
+	}
+	if _, _, ok := table.Lookup(netip.MustParseAddr("10.1.0.1")); ok {
+		t.Errorf("Lookup(10.1.0.1) should fail after DelPeer")
+	}
+	if peer, ok := table.Del(netip.MustParsePrefix("10.2.0.0/16")); !ok || peer != "a" {
+		t.Errorf("Del(10.2.0.0/16) = %s, %v, want a", peer, ok)
+	}
+}
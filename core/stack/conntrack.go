@@ -0,0 +1,266 @@
+package stack
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-cidranger/net"
+	"github.com/wlynxg/NetHive/core/protocol"
+)
+
+const (
+	// MaxFlows limits the size of the flow table, new flows are refused when it's full
+	MaxFlows = 1 << 16
+
+	TCPNewTimeout         = time.Minute
+	TCPEstablishedTimeout = 24 * time.Hour
+	TCPClosingTimeout     = 2 * time.Minute
+	TCPClosedTimeout      = 10 * time.Second
+	UDPNewTimeout         = 30 * time.Second
+	UDPEstablishedTimeout = 3 * time.Minute
+	ICMPTimeout           = 30 * time.Second
+)
+
+type FlowState int
+
+const (
+	// FlowNew no reply has been seen
+	FlowNew FlowState = iota
+	// FlowEstablished both directions have been seen
+	FlowEstablished
+	// FlowClosing a TCP FIN has been seen
+	FlowClosing
+	// FlowClosed a TCP RST has been seen
+	FlowClosed
+)
+
+func (s FlowState) String() string {
+	switch s {
+	case FlowNew:
+		return "new"
+	case FlowEstablished:
+		return "established"
+	case FlowClosing:
+		return "closing"
+	case FlowClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Tuple identify a flow in one direction, ICMP echo messages use the identifier as both ports
+type Tuple struct {
+	Protocol uint8
+	Src      netip.AddrPort
+	Dst      netip.AddrPort
+}
+
+func (t Tuple) Reverse() Tuple {
+	return Tuple{Protocol: t.Protocol, Src: t.Dst, Dst: t.Src}
+}
+
+func (t Tuple) Hash() Hash {
+	version := net.IPv4
+	if t.Src.Addr().Is6() {
+		version = net.IPv6
+	}
+	return NetHash(version, t.Src, t.Dst)
+}
+
+// Flow is a tracked connection, Tuple is the direction of its first packet
+type Flow struct {
+	Tuple
+	Peer string
+	// Outbound report whether the flow is started by the local side
+	Outbound bool
+	State    FlowState
+
+	OrigPackets, OrigBytes   uint64
+	ReplyPackets, ReplyBytes uint64
+	Created, LastSeen        time.Time
+	Expires                  time.Time
+}
+
+// ConnTrack is a table of TCP, UDP and ICMP echo flows keyed by NetHash of the original tuple
+type ConnTrack struct {
+	mu    sync.Mutex
+	flows map[Hash][]*Flow
+	count int
+}
+
+func NewConnTrack() *ConnTrack {
+	return &ConnTrack{flows: make(map[Hash][]*Flow)}
+}
+
+// TupleOf return the tuple of a trackable packet, fragments and protocols other than
+// TCP, UDP and ICMP echo aren't trackable
+func TupleOf(ip protocol.IP) (Tuple, bool) {
+	t := Tuple{Protocol: ip.Protocol()}
+	if ip.Fragment() {
+		return t, false
+	}
+	switch ip.Protocol() {
+	case protocol.ProtocolTCP, protocol.ProtocolUDP:
+		t.Src = netip.AddrPortFrom(ip.Src(), ip.SrcPort())
+		t.Dst = netip.AddrPortFrom(ip.Dst(), ip.DstPort())
+	case protocol.ProtocolICMP, protocol.ProtocolICMPv6:
+		switch ip.ICMPType() {
+		case protocol.ICMPEchoRequest, protocol.ICMPEchoReply, protocol.ICMPv6EchoRequest, protocol.ICMPv6EchoReply:
+		default:
+			return t, false
+		}
+		t.Src = netip.AddrPortFrom(ip.Src(), ip.ICMPID())
+		t.Dst = netip.AddrPortFrom(ip.Dst(), ip.ICMPID())
+	default:
+		return t, false
+	}
+	return t, true
+}
+
+// Track update the flow of ip and report whether the packet passes. A reply of a tracked
+// flow always passes, other packets pass if accept returns true, and a flow is created for them.
+// Untrackable packets are decided by accept alone.
+func (c *ConnTrack) Track(ip protocol.IP, size int, outbound bool, peer string, accept func() bool) bool {
+	t, ok := TupleOf(ip)
+	if !ok {
+		return accept()
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if flow := c.lookup(t.Reverse()); flow != nil && flow.Outbound != outbound {
+		flow.ReplyPackets++
+		flow.ReplyBytes += uint64(size)
+		if flow.State == FlowNew {
+			flow.State = FlowEstablished
+		}
+		flow.update(ip, now)
+		return true
+	}
+
+	if !accept() {
+		return false
+	}
+
+	flow := c.lookup(t)
+	if flow == nil || flow.Outbound != outbound {
+		if c.count >= MaxFlows {
+			return false
+		}
+		flow = &Flow{Tuple: t, Peer: peer, Outbound: outbound, Created: now}
+		if t.Protocol == protocol.ProtocolTCP && ip.TCPFlags()&(protocol.TCPSyn|protocol.TCPAck) != protocol.TCPSyn {
+			// pick up a connection in the middle, e.g. after a restart
+			flow.State = FlowEstablished
+		}
+		h := t.Hash()
+		c.flows[h] = append(c.flows[h], flow)
+		c.count++
+	}
+	flow.OrigPackets++
+	flow.OrigBytes += uint64(size)
+	flow.update(ip, now)
+	return true
+}
+
+func (c *ConnTrack) lookup(t Tuple) *Flow {
+	for _, flow := range c.flows[t.Hash()] {
+		if flow.Tuple == t {
+			return flow
+		}
+	}
+	return nil
+}
+
+// update move the TCP state by the flags of ip and refresh the timeout
+func (f *Flow) update(ip protocol.IP, now time.Time) {
+	f.LastSeen = now
+	if f.Protocol == protocol.ProtocolTCP {
+		flags := ip.TCPFlags()
+		switch {
+		case flags&protocol.TCPRst != 0:
+			f.State = FlowClosed
+		case flags&protocol.TCPFin != 0 && f.State != FlowClosed:
+			f.State = FlowClosing
+		}
+	}
+	f.Expires = now.Add(f.timeout())
+}
+
+func (f *Flow) timeout() time.Duration {
+	switch f.Protocol {
+	case protocol.ProtocolTCP:
+		switch f.State {
+		case FlowNew:
+			return TCPNewTimeout
+		case FlowEstablished:
+			return TCPEstablishedTimeout
+		case FlowClosing:
+			return TCPClosingTimeout
+		default:
+			return TCPClosedTimeout
+		}
+	case protocol.ProtocolUDP:
+		if f.State == FlowNew {
+			return UDPNewTimeout
+		}
+		return UDPEstablishedTimeout
+	}
+	return ICMPTimeout
+}
+
+// Expire remove flows which time out before now and return the number of removed flows
+func (c *ConnTrack) Expire(now time.Time) int {
+	return c.remove(func(flow *Flow) bool { return !flow.Expires.After(now) })
+}
+
+// DelPeer remove all flows of peer
+func (c *ConnTrack) DelPeer(peer string) {
+	c.remove(func(flow *Flow) bool { return flow.Peer == peer })
+}
+
+func (c *ConnTrack) remove(match func(flow *Flow) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for h, flows := range c.flows {
+		alive := flows[:0]
+		for _, flow := range flows {
+			if !match(flow) {
+				alive = append(alive, flow)
+			}
+		}
+		removed += len(flows) - len(alive)
+		if len(alive) == 0 {
+			delete(c.flows, h)
+		} else {
+			clear(flows[len(alive):])
+			c.flows[h] = alive
+		}
+	}
+	c.count -= removed
+	return removed
+}
+
+// Flows return a copy of all tracked flows
+func (c *ConnTrack) Flows() []Flow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flows := make([]Flow, 0, c.count)
+	for _, bucket := range c.flows {
+		for _, flow := range bucket {
+			flows = append(flows, *flow)
+		}
+	}
+	return flows
+}
+
+func (c *ConnTrack) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
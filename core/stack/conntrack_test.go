@@ -0,0 +1,69 @@
+package stack
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/wlynxg/NetHive/core/protocol"
+)
+
+func tcpPacket(src, dst netip.AddrPort, flags uint8) protocol.IP {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[9] = protocol.ProtocolTCP
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(b[12:], s[:])
+	copy(b[16:], d[:])
+	binary.BigEndian.PutUint16(b[20:], src.Port())
+	binary.BigEndian.PutUint16(b[22:], dst.Port())
+	b[33] = flags
+	ip, err := protocol.ParseIP(b)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func TestConnTrack(t *testing.T) {
+	var (
+		local  = netip.MustParseAddrPort("10.0.0.1:40000")
+		remote = netip.MustParseAddrPort("10.0.0.2:22")
+		ct     = NewConnTrack()
+		deny   = func() bool { return false }
+		allow  = func() bool { return true }
+	)
+
+	// unsolicited inbound packets are decided by accept
+	if ct.Track(tcpPacket(remote, local, protocol.TCPSyn), 40, false, "peer", deny) {
+		t.Fatal("unsolicited packet passed")
+	}
+	if ct.Len() != 0 {
+		t.Fatalf("ct.Len() = %d, want 0", ct.Len())
+	}
+
+	if !ct.Track(tcpPacket(local, remote, protocol.TCPSyn), 40, true, "peer", allow) {
+		t.Fatal("outbound packet dropped")
+	}
+	if !ct.Track(tcpPacket(remote, local, protocol.TCPSyn|protocol.TCPAck), 40, false, "peer", deny) {
+		t.Fatal("reply dropped")
+	}
+
+	flows := ct.Flows()
+	if len(flows) != 1 {
+		t.Fatalf("len(flows) = %d, want 1", len(flows))
+	}
+	if f := flows[0]; f.State != FlowEstablished || !f.Outbound || f.OrigPackets != 1 || f.ReplyPackets != 1 {
+		t.Fatalf("flow = %+v", f)
+	}
+
+	ct.Track(tcpPacket(local, remote, protocol.TCPRst), 40, true, "peer", allow)
+	if state := ct.Flows()[0].State; state != FlowClosed {
+		t.Fatalf("state = %s, want %s", state, FlowClosed)
+	}
+	if n := ct.Expire(time.Now().Add(TCPClosedTimeout + time.Second)); n != 1 || ct.Len() != 0 {
+		t.Fatalf("Expire() = %d, ct.Len() = %d, want 1, 0", n, ct.Len())
+	}
+}
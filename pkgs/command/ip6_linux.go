@@ -0,0 +1,18 @@
+package command
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+func IP6AddAddr(addr netip.Prefix, dev string) error {
+	cmd := fmt.Sprintf("ip -6 addr add %s dev %s", addr.String(), dev)
+	_, _, err := Bash(cmd)
+	return err
+}
+
+func IP6FlushAddr(dev string) error {
+	cmd := fmt.Sprintf("ip -6 addr flush dev %s scope global", dev)
+	_, _, err := Bash(cmd)
+	return err
+}
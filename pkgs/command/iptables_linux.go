@@ -0,0 +1,28 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+)
+
+func iptables(v6 bool) string {
+	if v6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// IPTablesAppend append a rule to chain, the rule is skipped if it already exists
+func IPTablesAppend(v6 bool, table, chain string, rule ...string) error {
+	bin, args := iptables(v6), strings.Join(rule, " ")
+	cmd := fmt.Sprintf("%s -t %s -C %s %s 2>/dev/null || %s -t %s -A %s %s", bin, table, chain, args, bin, table, chain, args)
+	_, _, err := Bash(cmd)
+	return err
+}
+
+// IPTablesDelete delete a rule from chain
+func IPTablesDelete(v6 bool, table, chain string, rule ...string) error {
+	cmd := fmt.Sprintf("%s -t %s -D %s %s", iptables(v6), table, chain, strings.Join(rule, " "))
+	_, _, err := Bash(cmd)
+	return err
+}
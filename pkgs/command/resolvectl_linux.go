@@ -0,0 +1,36 @@
+package command
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// HasResolved report whether systemd-resolved manages the system resolver
+func HasResolved() bool {
+	if _, err := os.Stat("/run/systemd/resolve/stub-resolv.conf"); err != nil {
+		return false
+	}
+	_, _, err := Bash("resolvectl status")
+	return err == nil
+}
+
+// ResolvectlLink send the queries of domain to the DNS server of dev
+func ResolvectlLink(dev string, server netip.Addr, domain string) error {
+	cmds := []string{
+		fmt.Sprintf("resolvectl dns %s %s", dev, server),
+		fmt.Sprintf("resolvectl domain %s '~%s'", dev, domain),
+		fmt.Sprintf("resolvectl default-route %s false", dev),
+	}
+	for _, cmd := range cmds {
+		if _, _, err := Bash(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ResolvectlRevert(dev string) error {
+	_, _, err := Bash(fmt.Sprintf("resolvectl revert %s", dev))
+	return err
+}
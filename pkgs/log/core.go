@@ -68,10 +68,7 @@ func ConsoleCore(cfg CoreConfig) zapcore.Core {
 		encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	}
 
-	level, err := zap.ParseAtomicLevel(cfg.Level)
-	if err != nil {
-		level = zap.NewAtomicLevelAt(zap.InfoLevel)
-	}
+	level := atomicLevel(cfg)
 
 	encoder := zapcore.NewConsoleEncoder(encoderConfig)
 	switch cfg.EncodeType {
@@ -113,10 +110,7 @@ func FileCore(cfg CoreConfig) zapcore.Core {
 		encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	}
 
-	level, err := zap.ParseAtomicLevel(cfg.Level)
-	if err != nil {
-		level = zap.NewAtomicLevelAt(zap.InfoLevel)
-	}
+	level := atomicLevel(cfg)
 
 	encoder := zapcore.NewConsoleEncoder(encoderConfig)
 	switch cfg.EncodeType {
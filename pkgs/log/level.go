@@ -0,0 +1,51 @@
+package mlog
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	levelsMu sync.Mutex
+	// levels is shared by the cores of all loggers writing to the same output
+	levels = make(map[string]zap.AtomicLevel)
+)
+
+func outputKey(cfg CoreConfig) string {
+	return cfg.OutputType + ":" + cfg.OutputPath
+}
+
+func parseLevel(level string) zapcore.Level {
+	l, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return zapcore.InfoLevel
+	}
+	return l
+}
+
+func atomicLevel(cfg CoreConfig) zap.AtomicLevel {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	key := outputKey(cfg)
+	level, ok := levels[key]
+	if !ok {
+		level = zap.NewAtomicLevelAt(parseLevel(cfg.Level))
+		levels[key] = level
+	}
+	return level
+}
+
+// SetLevels change the level of existing outputs at runtime, other changes of outputs need a restart
+func SetLevels(configs ...CoreConfig) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	for _, cfg := range configs {
+		if level, ok := levels[outputKey(cfg)]; ok {
+			level.SetLevel(parseLevel(cfg.Level))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sysctlPath = "/proc/sys"
+)
+
+// Sysctl read a kernel parameter, such as net.ipv4.ip_forward
+func Sysctl(key string) (string, error) {
+	value, err := os.ReadFile(filepath.Join(sysctlPath, strings.ReplaceAll(key, ".", "/")))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// SetSysctl write a kernel parameter and return the old value
+func SetSysctl(key, value string) (string, error) {
+	old, err := Sysctl(key)
+	if err != nil {
+		return "", err
+	}
+	if old == value {
+		return old, nil
+	}
+	return old, os.WriteFile(filepath.Join(sysctlPath, strings.ReplaceAll(key, ".", "/")), []byte(value), 0644)
+}